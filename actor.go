@@ -1,11 +1,12 @@
 package ipc
 
 import (
-	"bufio"
 	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"github.com/sirupsen/logrus"
+	"io"
 	"net"
 	"os"
 	"sync"
@@ -18,10 +19,21 @@ func NewActor(ac *ActorConfig) Actor {
 
 	logger := logrus.New()
 	var logLevel logrus.Level
+	var codec Codec
+	var compressor Compressor
+	var compressionThreshold int
+	var receiveBuffer, sendBuffer int
+	var flowPolicy FlowPolicy
 	if ac.IsServer && ac.ServerConfig != nil {
 		logLevel = getLogrusLevel(ac.ServerConfig.LogLevel)
+		codec = ac.ServerConfig.Codec
+		compressor, compressionThreshold = ac.ServerConfig.Compressor, ac.ServerConfig.CompressionThreshold
+		receiveBuffer, sendBuffer, flowPolicy = ac.ServerConfig.ReceiveBuffer, ac.ServerConfig.SendBuffer, ac.ServerConfig.FlowPolicy
 	} else if !ac.IsServer && ac.ClientConfig != nil {
 		logLevel = getLogrusLevel(ac.ClientConfig.LogLevel)
+		codec = ac.ClientConfig.Codec
+		compressor, compressionThreshold = ac.ClientConfig.Compressor, ac.ClientConfig.CompressionThreshold
+		receiveBuffer, sendBuffer, flowPolicy = ac.ClientConfig.ReceiveBuffer, ac.ClientConfig.SendBuffer, ac.ClientConfig.FlowPolicy
 	} else {
 		logLevel = getLogrusLevel("")
 	}
@@ -35,20 +47,50 @@ func NewActor(ac *ActorConfig) Actor {
 	})
 
 	return Actor{
-		status:   NotConnected,
-		received: make(chan *Message),
-		toWrite:  make(chan *Message),
-		logger:   logger,
-		config:   ac,
-		mutex:    &sync.Mutex{},
+		status:               NotConnected,
+		received:             make(chan *Message, max(receiveBuffer, 0)),
+		toWrite:              make(chan *frame, max(sendBuffer, 0)),
+		toWriteHigh:          make(chan *frame, max(sendBuffer, 0)),
+		toWriteLow:           make(chan *frame, max(sendBuffer, 0)),
+		events:               make(chan *Event, EVENT_BUFFER_SIZE),
+		logger:               logger,
+		config:               ac,
+		calls:                newCallRegistry(),
+		streams:              newStreamRegistry(),
+		session:              newSession(),
+		nonces:               &nonceCounters{},
+		flow:                 newFlowControl(max(receiveBuffer, 0), flowPolicy),
+		codec:                getCodec(codec),
+		compressor:           compressor,
+		compressionThreshold: getCompressionThreshold(compressionThreshold),
+		mutex:                &sync.Mutex{},
+		eventMutex:           &sync.Mutex{},
+		closeOnce:            &sync.Once{},
+		done:                 make(chan struct{}),
+		lastReceived:         new(int64),
+		delivering:           new(int32),
 	}
 }
 
-// Read - blocking function, reads each message received
-// if MsgType is a negative number it's an internal message
+// Read - blocking function, reads each message received. Status changes and errors are
+// delivered by Events, an error is only returned once the connection has been closed.
 func (a *Actor) Read() (*Message, error) {
+	return a.ReadContext(context.Background())
+}
 
-	m, ok := <-a.received
+// ReadContext - blocks until a message is received or the context is done, in which case
+// the context error is returned
+func (a *Actor) ReadContext(ctx context.Context) (*Message, error) {
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case m, ok := <-a.received:
+		return a.onReceived(m, ok)
+	}
+}
+
+func (a *Actor) onReceived(m *Message, ok bool) (*Message, error) {
 
 	if !ok {
 		err := errors.New("the received channel has been closed")
@@ -56,13 +98,9 @@ func (a *Actor) Read() (*Message, error) {
 		return nil, err
 	}
 
-	if m.Err != nil {
-		a.logger.Errorf("%s.Read err: %s", a, m.Err)
-		if !a.config.IsServer {
-			close(a.received)
-			close(a.toWrite)
-		}
-		return nil, m.Err
+	//the stream has been credited as its chunks were received
+	if m.Stream == nil {
+		a.flow.consume()
 	}
 
 	return m, nil
@@ -74,33 +112,15 @@ func (a *Actor) ReadTimed(duration time.Duration) (*Message, error) {
 
 func (a *Actor) ReadTimedTimeoutMessage(duration time.Duration, onTimeoutMessage *Message) (*Message, error) {
 
-	readMsgChan := make(chan *Message, 1)
-	readErrChan := make(chan error, 1)
-
 	ctx, cancel := context.WithTimeout(context.Background(), duration)
 	defer cancel()
 
-	go func() {
-		m, err := a.Read()
-		readMsgChan <- m
-		readErrChan <- err
-	}()
-
-	select {
-	case <-ctx.Done():
-
-		go func() {
-			//requeue the message when the Read task does finally finish
-			msg := <-readMsgChan
-			if msg != nil && a.getStatus() < Closed {
-				a.logger.Debugf("%s.ReadTimed recycling timed-out message %s", a, msg.Data)
-				a.received <- msg
-			}
-		}()
+	m, err := a.ReadContext(ctx)
+	if err == context.DeadlineExceeded {
 		return onTimeoutMessage, nil
-	case msg := <-readMsgChan:
-		return msg, <-readErrChan
 	}
+
+	return m, err
 }
 
 func (a *Actor) WriteMessage(msg *Message) error {
@@ -110,50 +130,158 @@ func (a *Actor) WriteMessage(msg *Message) error {
 // Write - writes a  message to the ipc connection.
 // msgType - denotes the type of data being sent. 0 is a reserved type for internal messages and errors.
 func (a *Actor) Write(msgType int, message []byte) error {
+	return a.WriteContext(context.Background(), msgType, message)
+}
 
-	if msgType == 0 {
-		err := errors.New("message type 0 is reserved")
+// WriteContext - writes a message to the ipc connection, giving up waiting for the
+// connection to be established or the message to be queued when the context is done
+func (a *Actor) WriteContext(ctx context.Context, msgType int, message []byte) error {
+	return a.WriteContextWithPriority(ctx, PriorityNormal, msgType, message)
+}
+
+// writeFrame - every write ends up here. A MultiClient server accepts many clients so its
+// messages must be written with Connections.SendTo or Connections.Broadcast.
+func (a *Actor) writeFrame(ctx context.Context, f *frame) error {
+
+	if a.config.IsServer && a.serverRef.Connections != nil {
+		err := errors.New("cannot write to a multi-client server, use Connections.SendTo or Connections.Broadcast")
 		a.logger.Errorf("%s.Write err: %s", a, err)
 		return err
 	}
 
+	if !a.config.IsServer && a.clientRef.outbox != nil {
+		queued, err := a.clientRef.outbox.queue(ctx, a.clientRef, f)
+		if queued || err != nil {
+			return err
+		}
+	}
+
 	status := a.getStatus()
 
-	if a.config.IsServer && status == Listening {
-		time.Sleep(time.Millisecond * 2)
-		a.logger.Infoln("Server is still listening so lets use recursion")
-		//it's possible the client hasn't connected yet so retry it
-		return a.Write(msgType, message)
-	} else if !a.config.IsServer && status == Connecting {
-		a.logger.Infoln("Client is still connecting so lets use recursion")
-		time.Sleep(time.Millisecond * 100)
-		return a.Write(msgType, message)
-	} else if status != Connected {
+	for (a.config.IsServer && status == Listening) || (!a.config.IsServer && status == Connecting) {
+
+		//it's possible the client hasn't connected yet so wait for it
+		wait := time.Millisecond * 2
+		if !a.config.IsServer {
+			wait = time.Millisecond * 100
+		}
+		a.logger.Infof("%s is not connected yet so lets wait", a)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+
+		status = a.getStatus()
+	}
+
+	if status != Connected {
 		err := errors.New(fmt.Sprintf("cannot write under current status: %s", a.Status()))
 		a.logger.Errorf("%s.Write err: %s", a, err)
 		return err
 	}
 
-	mlen := len(message)
-	if a.config.IsServer {
-		if mlen > a.config.ServerConfig.MaxMsgSize {
-			err := errors.New("message exceeds maximum message length")
+	if len(f.data) > a.getMaxMsgSize() {
+		err := errors.New("message exceeds maximum message length")
+		a.logger.Errorf("%s.Write err: %s", a, err)
+		return err
+	}
+
+	if f.credited() {
+		ok, err := a.flow.acquire(ctx, a.done)
+		if err != nil {
 			a.logger.Errorf("%s.Write err: %s", a, err)
 			return err
 		}
-	} else if mlen > a.clientRef.maxMsgSize {
-		err := errors.New("message exceeds maximum message length")
+		if !ok {
+			a.logger.Debugf("%s.Write dropped a message as the receive window of the other side is full", a)
+			return ErrDropped
+		}
+	}
+
+	if err := a.persist(f); err != nil {
+		a.flow.grant(1)
+		return err
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-a.done:
+		err := errors.New("the connection has been closed")
 		a.logger.Errorf("%s.Write err: %s", a, err)
 		return err
+	case a.queueFor(f) <- f:
+		return nil
 	}
+}
 
-	a.toWrite <- &Message{MsgType: msgType, Data: message}
+// requeue - queues a message which an earlier write has already accepted, such as one buffered while
+// reconnecting. It waits for a credit whatever the FlowPolicy, as the write has already returned.
+func (a *Actor) requeue(queue chan *frame, f *frame) bool {
 
-	return nil
+	if f.credited() {
+		if ok, _ := a.flow.acquireWith(context.Background(), a.done, FlowBlock); !ok {
+			return false
+		}
+	}
+
+	select {
+	case <-a.done:
+		return false
+	case queue <- f:
+		return true
+	}
+}
+
+// getMaxMsgSize - the largest message the other side of the connection accepts
+func (a *Actor) getMaxMsgSize() int {
+	if a.config.IsServer {
+		return a.config.ServerConfig.MaxMsgSize
+	}
+	return a.clientRef.maxMsgSize
+}
+
+// withContext - bounds the blocking operations performed on the connection, such as
+// the handshake, by the context deadline and cancellation
+func (a *Actor) withContext(ctx context.Context, operation func() error) error {
+
+	conn := a.getConn()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+
+	err := operation()
+
+	if !stop() && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	conn.SetDeadline(time.Time{})
+
+	return err
+}
+
+// connectionEnded - whether a read error means the connection has ended, which is any error other
+// than a read deadline passing: the other side closed or reset it, keepalive or tls gave up on it,
+// or this side closed it as the heartbeat timed out or the frames received couldn't be trusted
+func (a *Actor) connectionEnded(err error) bool {
+	return !errors.Is(err, os.ErrDeadlineExceeded) || a.getStatus() == Timeout
 }
 
 func (a *Actor) read(readBytesCb func(*Actor, []byte) bool) {
 	bLen := make([]byte, 4)
+	fragments := make(map[byte][]byte)
+	oversized := make(map[byte]bool)
+
+	a.receivedAt(time.Now())
+	stopHeartbeat := make(chan struct{})
+	defer close(stopHeartbeat)
+	go a.heartbeat(stopHeartbeat)
 
 	for {
 		res := readBytesCb(a, bLen)
@@ -172,105 +300,151 @@ func (a *Actor) read(readBytesCb func(*Actor, []byte) bool) {
 
 		if a.shouldUseEncryption() {
 			var err error
-			msgRecvd, err = decrypt(*a.cipher, msgRecvd)
-			if err != nil {
+			msgRecvd, err = a.decrypt(msgRecvd)
+			if err == ErrReplayedFrame {
+				a.logger.Errorf("%s.read err: %s", a, err)
+				a.dispatchError(err)
+				continue
+			} else if err != nil {
+				//the messages which follow can't be trusted, the connection is re-established
+				a.logger.Errorf("%s.read err: %s", a, err)
 				a.dispatchError(err)
+				a.getConn().Close()
 				continue
 			}
 		}
 
-		msgType := bytesToInt(msgRecvd[:4])
-		msgData := msgRecvd[4:]
+		f, err := decodeFrame(msgRecvd)
+		if err != nil {
+			//it can't be told whether the frame used a credit, granting one back is safer than the writer waiting forever
+			a.dispatchError(err)
+			a.flow.consume()
+			continue
+		}
+		a.receivedAt(time.Now())
+
+		a.acknowledged(f.ack)
+
+		err = a.decompress(f)
+		if err != nil {
+			a.logger.Errorf("%s.read err: %s", a, err)
+			a.dispatchError(err)
+			a.discard(f)
+			continue
+		}
 
-		if msgType == 0 {
+		//the fragments of a frame are joined once its last fragment is received, those of a
+		//frame which exceeds the maximum message length are discarded up to its last fragment
+		if lane := f.fragment &^ fragmentMore; lane != 0 {
+			if !oversized[lane] && len(fragments[lane])+len(f.data) > max(a.getMaxMsgSize(), FRAGMENT_SIZE) {
+				err := errors.New("fragmented message exceeds maximum message length")
+				a.logger.Errorf("%s.read err: %s", a, err)
+				a.dispatchError(err)
+				oversized[lane] = true
+				delete(fragments, lane)
+			}
+			if oversized[lane] {
+				if f.fragment&fragmentMore == 0 {
+					delete(oversized, lane)
+					a.discard(f)
+				}
+				continue
+			}
+
+			fragments[lane] = append(fragments[lane], f.data...)
+			if f.fragment&fragmentMore != 0 {
+				continue
+			}
+			f.data = fragments[lane]
+			f.fragment = 0
+			delete(fragments, lane)
+		}
+
+		if a.session.duplicate(f) {
+			a.logger.Debugf("%s.read discarded message %d which has already been received", a, f.seq)
+			a.discard(f)
+			continue
+		}
+
+		if f.msgType == 0 {
 			//  type 0 = control message
 			a.logger.Debugf("%s.read - control message encountered", a)
+			if f.flags&frameCredit != 0 && len(f.data) >= 4 {
+				credits := int(binary.BigEndian.Uint32(f.data))
+				switch {
+				case f.flags&frameConn != 0:
+					a.getTunnel().grant(credits)
+				case f.flags&frameChunk != 0:
+					a.streams.grant(f.requestId, credits)
+				default:
+					a.flow.grant(credits)
+				}
+			} else if f.flags&frameConn != 0 {
+				a.getTunnel().receive(f)
+			}
 		} else {
-			a.received <- &Message{Data: msgData, MsgType: msgType}
+			//the messages handled without being read are credited straight away
+			if !a.dispatchFrame(f) && f.credited() {
+				a.flow.consume()
+			}
+			a.session.delivered(f)
 		}
 	}
+
+	//the streams being received won't receive the rest of their chunks
+	a.streams.abort(io.ErrUnexpectedEOF)
+	a.getTunnel().end()
+}
+
+// discard - a message which won't be read gives back the credit the other side used to write it,
+// a fragmented message used a single credit which is given back with its last fragment
+func (a *Actor) discard(f *frame) {
+	if f.credited() && f.fragment&fragmentMore == 0 {
+		a.flow.consume()
+	}
 }
 
 func (a *Actor) write() {
 
-	for {
+	lanes := map[byte]*writeLane{
+		laneHigh:   {id: laneHigh, queue: a.toWriteHigh},
+		laneNormal: {id: laneNormal, queue: a.toWrite},
+		laneLow:    {id: laneLow, queue: a.toWriteLow},
+		laneReplay: {id: laneReplay},
+	}
+	turn := 0
 
-		m, ok := <-a.toWrite
+	for {
 
-		if !ok {
-			break
+		f, lane := a.nextFrame(lanes, &turn)
+		if f == nil {
+			return
 		}
 
-		toSend := append(intToBytes(m.MsgType), m.Data...)
-		writer := bufio.NewWriter(a.getConn())
+		compressed, err := a.compress(f)
+		if err != nil {
+			a.logger.Errorf("%s.write err: %s", a, err)
+			a.dispatchError(err)
+		}
+		toSend := compressed.encode()
 
 		if a.shouldUseEncryption() {
-			var err error
-			toSend, err = encrypt(*a.cipher, toSend)
+			toSend, err = a.encrypt(toSend)
 			if err != nil {
 				a.dispatchError(err)
 				continue
 			}
 		}
 
-		//first send the message size
-		_, err := writer.Write(intToBytes(len(toSend)))
-		if err != nil {
-			a.logger.Errorf("%s error writing message size: %s", a, err)
-		}
-		//last send the message
-		_, err = writer.Write(toSend)
+		//the message size followed by the message
+		_, err = a.getConn().Write(append(intToBytes(len(toSend)), toSend...))
 		if err != nil {
 			a.logger.Errorf("%s error writing message: %s", a, err)
+			a.abandonFragments(lane)
 		}
-
-		if a.getStatus() <= 4 {
-			err = writer.Flush()
-			if err != nil {
-				a.logger.Errorf("%s error flushing data: %s", a, err)
-				continue
-			}
-		}
-	}
-}
-
-func (a *Actor) _dispatchStatus(status Status, blocking bool) {
-	a.logger.Debugf("Actor.dispacthStatus(%s): %s", a, status)
-	a.setStatus(status)
-	if blocking {
-		a.received <- &Message{Status: status.String(), MsgType: -1}
-	} else {
-		go func() {
-			a.received <- &Message{Status: status.String(), MsgType: -1}
-		}()
 	}
 }
 
-func (a *Actor) dispatchStatusBlocking(status Status) {
-	a._dispatchStatus(status, true)
-}
-
-func (a *Actor) dispatchStatus(status Status) {
-	a._dispatchStatus(status, false)
-}
-
-func (a *Actor) dispatchErrorBlocking(err error) {
-	a.logger.Debugf("Actor.dispacthError(%s): %s", a, err)
-	a.received <- &Message{Err: err, MsgType: -1}
-}
-
-func (a *Actor) dispatchErrorStrBlocking(err string) {
-	a.dispatchErrorBlocking(errors.New(err))
-}
-
-func (a *Actor) dispatchErrorStr(err string) {
-	go a.dispatchErrorStrBlocking(err)
-}
-
-func (a *Actor) dispatchError(err error) {
-	go a.dispatchErrorBlocking(err)
-}
-
 // getStatus - get the current status of the connection
 func (a *Actor) getStatus() Status {
 	a.mutex.Lock()
@@ -317,6 +491,10 @@ func (a *Actor) Close() {
 
 	a.setStatus(Closing)
 
+	if a.calls != nil {
+		a.calls.cancel(errors.New("the connection has been closed"))
+	}
+
 	if a.conn != nil {
 		a.getConn().Close()
 	}
@@ -324,7 +502,7 @@ func (a *Actor) Close() {
 
 func (a *Actor) String() string {
 	if a.config.IsServer {
-		return fmt.Sprintf("Server(%s)", a.getStatus())
+		return a.serverRef.String()
 	} else {
 		return a.clientRef.String()
 	}
@@ -0,0 +1,163 @@
+package ipc
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+// ErrUnauthorized - dispatched by the server when a client fails to prove it has the pre-shared key,
+// the connection is closed and the server carries on listening
+var ErrUnauthorized = errors.New("client failed to authenticate with the pre-shared key")
+
+// authNonceLen - the length of the random nonces exchanged by the challenge/response
+const authNonceLen = 32
+
+// requiresPreSharedKey - whether the server only accepts clients which prove they have a pre-shared key
+func (sc *Server) requiresPreSharedKey() bool {
+	return len(sc.config.ServerConfig.PreSharedKey) > 0 || len(sc.config.ServerConfig.PreSharedKeys) > 0
+}
+
+// preSharedKey - the key of the PreSharedKeyId sent by the client, the PreSharedKey is used for an empty id
+func (sc *Server) preSharedKey(id string) ([]byte, bool) {
+
+	if id == "" && len(sc.config.ServerConfig.PreSharedKey) > 0 {
+		return sc.config.ServerConfig.PreSharedKey, true
+	}
+
+	key, ok := sc.config.ServerConfig.PreSharedKeys[id]
+	return key, ok && len(key) > 0
+}
+
+func (cc *Client) hasPreSharedKey() bool {
+	return len(cc.config.ClientConfig.PreSharedKey) > 0
+}
+
+// authenticate - challenges the client to prove it has the pre-shared key of the id it sends, then
+// proves the server has the key too. The proofs are bound to the shared secret of the key exchange
+// so they can't be relayed to another connection, and the key is mixed into the cipher.
+// The client sends its nonce followed by its id, the server replies with its challenge, the client
+// sends its proof and the server replies with byte 0 = 0 followed by its own proof, or 1 when rejected
+func (sc *Server) authenticate(shared []byte) error {
+
+	buff, err := sc.handshakeRead()
+	if err != nil {
+		return errors.New(fmt.Sprintf("failed to received authentication: %s", err))
+	}
+	if len(buff) < authNonceLen {
+		return errors.New("failed to received authentication nonce")
+	}
+	nonce, id := buff[:authNonceLen], string(buff[authNonceLen:])
+
+	challenge := make([]byte, authNonceLen)
+	_, err = rand.Read(challenge)
+	if err != nil {
+		return err
+	}
+
+	//an unknown id is challenged all the same, so it can't be told apart from a wrong key
+	err = sc.handshakeWrite(challenge)
+	if err != nil {
+		return errors.New("unable to send authentication challenge")
+	}
+
+	proof, err := sc.handshakeRead()
+	if err != nil {
+		return errors.New(fmt.Sprintf("failed to received authentication proof: %s", err))
+	}
+
+	key, ok := sc.preSharedKey(id)
+	if !ok || !hmac.Equal(proof, authProof(key, "client", shared, nonce, challenge)) {
+		sc.handshakeWrite([]byte{1})
+		return ErrUnauthorized
+	}
+
+	err = sc.handshakeWrite(append([]byte{0}, authProof(key, "server", shared, nonce, challenge)...))
+	if err != nil {
+		return errors.New("unable to send authentication reply")
+	}
+	sc.keyId = id
+
+	return sc.mixPreSharedKey(key, shared)
+}
+
+// authenticate - proves the client has its pre-shared key and checks the server has it too
+func (cc *Client) authenticate(shared []byte) error {
+
+	key := cc.config.ClientConfig.PreSharedKey
+
+	nonce := make([]byte, authNonceLen)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return err
+	}
+
+	err = cc.handshakeWrite(append(nonce, cc.config.ClientConfig.PreSharedKeyId...))
+	if err != nil {
+		return errors.New("unable to send authentication")
+	}
+
+	challenge, err := cc.handshakeRead()
+	if err != nil {
+		return errors.New(fmt.Sprintf("failed to received authentication challenge: %s", err))
+	}
+
+	err = cc.handshakeWrite(authProof(key, "client", shared, nonce, challenge))
+	if err != nil {
+		return errors.New("unable to send authentication proof")
+	}
+
+	reply, err := cc.handshakeRead()
+	if err != nil {
+		return errors.New(fmt.Sprintf("failed to received authentication reply: %s", err))
+	}
+
+	if len(reply) == 0 || reply[0] != 0 {
+		return errors.New("server rejected the pre-shared key")
+	}
+
+	if !hmac.Equal(reply[1:], authProof(key, "server", shared, nonce, challenge)) {
+		return errors.New("server failed to authenticate with the pre-shared key")
+	}
+
+	return cc.mixPreSharedKey(key, shared)
+}
+
+// authProof - the HMAC proving a side has the pre-shared key
+func authProof(key []byte, side string, shared []byte, nonce []byte, challenge []byte) []byte {
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("ipc " + side))
+	mac.Write(shared)
+	mac.Write(nonce)
+	mac.Write(challenge)
+
+	return mac.Sum(nil)
+}
+
+// mixPreSharedKey - replaces the cipher derived from the key exchange with one derived from both
+// the shared secret and the pre-shared key, so only a peer with the key can read the messages
+func (a *Actor) mixPreSharedKey(key []byte, shared []byte) error {
+
+	if !a.shouldUseEncryption() {
+		return nil
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("ipc key"))
+	mac.Write(shared)
+
+	var mixed [32]byte
+	copy(mixed[:], mac.Sum(nil))
+
+	gcm, err := createCipher(mixed)
+	if err != nil {
+		return err
+	}
+
+	a.cipher = gcm
+
+	return nil
+}
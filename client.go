@@ -2,25 +2,28 @@ package ipc
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"time"
 )
 
 // StartClient - start the ipc client.
 // ipcName = is the name of the unix socket or named pipe that the client will try and connect to.
 func StartClient(config *ClientConfig) (*Client, error) {
-	if config.MultiClient {
-		return StartClientPool(config)
-	} else {
-		cc, err := NewClient(config.Name, config)
-		if err != nil {
-			return nil, err
-		}
-		cc.ClientId = 0
-		return start(cc)
+	return StartClientContext(context.Background(), config)
+}
+
+// StartClientContext - start the ipc client, abandoning the dial and handshake when the
+// context is done. The context isn't used once the client has connected.
+func StartClientContext(ctx context.Context, config *ClientConfig) (*Client, error) {
+	cc, err := NewClient(config.Name, config)
+	if err != nil {
+		return nil, err
 	}
+	return start(ctx, cc)
 }
 
 func NewClient(name string, config *ClientConfig) (*Client, error) {
@@ -41,6 +44,7 @@ func NewClient(name string, config *ClientConfig) (*Client, error) {
 		ClientConfig: config,
 	})}
 	cc.clientRef = cc
+	cc.ctx, cc.cancel = context.WithCancel(context.Background())
 
 	config.Name = name
 
@@ -56,85 +60,135 @@ func NewClient(name string, config *ClientConfig) (*Client, error) {
 		cc.retryTimer = config.RetryTimer
 	}
 
+	cc.policy = getReconnectPolicy(config.ReconnectPolicy, cc.retryTimer)
+
+	if config.OutboundBuffer > 0 {
+		cc.outbox = newOutbox(config.OutboundBuffer, config.OutboundPolicy)
+	}
+
+	if config.DurableOutbox != nil {
+		cc.durable, err = openDurableOutbox(*config.DurableOutbox)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.Transport != nil {
+		cc.transport = config.Transport
+	} else {
+		cc.transport = defaultTransport()
+	}
+
 	return cc, err
 }
 
-func start(c *Client) (*Client, error) {
+func start(ctx context.Context, c *Client) (*Client, error) {
 	c.dispatchStatus(Connecting)
 
-	err := c.dial()
+	err := c.dial(ctx)
 	if err != nil {
+		c.setStatus(Error)
 		c.dispatchError(err)
+		c.terminate()
 		return c, err
 	}
 
 	go c.read(c.ByteReader)
 	go c.write()
+	c.replay()
+	c.flush()
 	c.dispatchStatus(Connected)
 
 	return c, nil
 }
 
 // Client connect to the unix socket created by the server -  for unix and linux
-func (c *Client) dial() error {
+func (c *Client) dial(ctx context.Context) error {
 
-	errChan := make(chan error, 1)
+	dialCtx := ctx
+	if c.timeout != 0 {
+		var cancel context.CancelFunc
+		dialCtx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
 
-	go func() {
-		startTime := time.Now()
-		for {
-			if c.timeout != 0 {
-				if time.Since(startTime) > c.timeout {
-					return
-				}
-			}
-			conn, err := c.connect()
+	for attempt := 1; ; attempt++ {
+		conn, err := c.connect(dialCtx)
+		if err != nil {
+			c.logger.Debugf("Client.dial err: %s", err)
+		} else {
+			c.setConn(conn)
+			err = c.withContext(dialCtx, c.handshake)
 			if err != nil {
-				c.logger.Debugf("Client.dial err: %s", err)
-			} else {
-				c.setConn(conn)
-				err = c.handshake()
-				if err != nil {
-					c.logger.Errorf("%s.dial handshake err: %s", c, err)
+				c.logger.Errorf("%s.dial handshake err: %s", c, err)
+				if dialCtx.Err() != nil {
+					conn.Close()
+					return c.dialContextErr(ctx)
 				}
-
-				errChan <- err
-				return
 			}
 
-			time.Sleep(c.retryTimer)
+			return err
+		}
+
+		if stop := c.policy.allow(attempt, err); stop != nil {
+			return stop
 		}
-	}()
 
-	if c.timeout != 0 {
-		ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
-		defer cancel()
 		select {
-		case <-ctx.Done():
-			return errors.New("timed out trying to connect")
-		case err := <-errChan:
-			return err
+		case <-dialCtx.Done():
+			return c.dialContextErr(ctx)
+		case <-time.After(c.policy.delay(attempt)):
 		}
-	} else {
-		return <-errChan
 	}
 }
 
+// dialContextErr - distinguishes the Timeout elapsing from the caller's context being done
+func (c *Client) dialContextErr(ctx context.Context) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return errors.New("timed out trying to connect")
+}
+
+func (c *Client) connect(ctx context.Context) (net.Conn, error) {
+
+	address := c.transport.Address(c.config.ClientConfig.Name)
+
+	conn, err := c.transport.Dial(ctx, address)
+	if err != nil {
+		c.logger.Debugf("%s.connect err: %s", c, err)
+		if !isTransientDialError(err) {
+			c.dispatchError(err)
+		}
+		return conn, err
+	}
+
+	//the TLS handshake is completed by the handshake of the connection
+	if c.usesTLS() {
+		conn = tls.Client(conn, c.clientTLSConfig(address))
+	}
+
+	return conn, nil
+}
+
 func (c *Client) ByteReader(a *Actor, buff []byte) bool {
 
 	_, err := io.ReadFull(a.getConn(), buff)
 	if err != nil {
 		a.logger.Debugf("%s.readData err: %s", c, err)
 		if c.getStatus() == Closing {
-			a.dispatchStatusBlocking(Closed)
-			a.dispatchErrorStrBlocking("client has closed the connection")
+			a.dispatchStatus(Closed)
+			a.dispatchErrorStr("client has closed the connection")
+			a.terminate()
 			return false
 		}
 
-		if err == io.EOF { // the connection has been closed by the client.
+		if a.connectionEnded(err) {
 			a.getConn().Close()
 
 			if a.getStatus() != Closing {
+				// writes are buffered from now on rather than written to the lost connection
+				c.setStatus(ReConnecting)
 				go reconnect(c)
 			}
 			return false
@@ -152,23 +206,58 @@ func reconnect(c *Client) {
 	c.logger.Warn("Client.reconnect called")
 	c.dispatchStatus(ReConnecting)
 
-	// IMPORTANT removing this line will allow a dial before the new connection
-	// is ready resulting in a dial hang when a timeout is not specified
-	time.Sleep(c.retryTimer)
-	err := c.dial()
+	err := c.policy.allow(0, nil)
+	if err == nil {
+		// IMPORTANT removing this wait will allow a dial before the new connection
+		// is ready resulting in a dial hang when a timeout is not specified
+		select {
+		case <-c.ctx.Done():
+			err = c.ctx.Err()
+		case <-time.After(c.policy.delay(0)):
+			err = c.dial(c.ctx)
+		}
+	}
 	if err != nil {
 		c.logger.Errorf("Client.reconnect -> dial err: %s", err)
-		if err.Error() == "timed out trying to connect" {
-			c.dispatchStatusBlocking(Timeout)
-			c.dispatchErrorStrBlocking("timed out trying to re-connect")
+		if c.getStatus() == Closing || c.ctx.Err() != nil {
+			c.dispatchStatus(Closed)
+		} else if err.Error() == "timed out trying to connect" {
+			c.dispatchStatus(Timeout)
+			c.dispatchErrorStr("timed out trying to re-connect")
+		} else {
+			c.dispatchError(err)
 		}
+		c.terminate()
 
 		return
 	}
 
+	//the connection is read before the buffered messages are written, as they wait for the credits it receives
+	go c.read(c.ByteReader)
+	c.replay()
+	c.flush()
 	c.dispatchStatus(Connected)
+}
 
-	go c.read(c.ByteReader)
+// flush - writes the messages buffered while connecting or reconnecting
+func (c *Client) flush() {
+	if c.outbox != nil {
+		c.outbox.flush(c)
+	}
+}
+
+// Close - closes the connection and stops any attempt to reconnect
+func (c *Client) Close() {
+
+	if c.cancel != nil {
+		c.cancel()
+	}
+
+	c.Actor.Close()
+
+	if c.durable != nil {
+		c.durable.close()
+	}
 }
 
 // getStatus - get the current status of the connection
@@ -0,0 +1,96 @@
+package ipc
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Codec - marshals the values written with WriteValue and unmarshals the values read with
+// ReadValue. The server and client must use a Codec with the same Name, which is checked
+// during the handshake.
+type Codec interface {
+	// Name - identifies the encoding to the other side of the connection
+	Name() string
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+// JSONCodec - encodes values with encoding/json, the default Codec
+type JSONCodec struct{}
+
+func (JSONCodec) Name() string {
+	return "json"
+}
+
+func (JSONCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+// GobCodec - encodes values with encoding/gob, each value is encoded as a separate stream so
+// the types are sent along with every message
+type GobCodec struct{}
+
+func (GobCodec) Name() string {
+	return "gob"
+}
+
+func (GobCodec) Marshal(v any) ([]byte, error) {
+	var buff bytes.Buffer
+	err := gob.NewEncoder(&buff).Encode(v)
+	return buff.Bytes(), err
+}
+
+func (GobCodec) Unmarshal(data []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// WriteValue - marshals the value with the Codec of the connection and writes it as a message of msgType
+func (a *Actor) WriteValue(msgType int, v any) error {
+
+	data, err := a.codec.Marshal(v)
+	if err != nil {
+		err = errors.New(fmt.Sprintf("unable to marshal the value: %s", err))
+		a.logger.Errorf("%s.WriteValue err: %s", a, err)
+		return err
+	}
+
+	return a.Write(msgType, data)
+}
+
+// ReadValue - blocks until a message is received and unmarshals its data into the value
+// with the Codec of the connection. The message is returned so its MsgType can be checked.
+func (a *Actor) ReadValue(v any) (*Message, error) {
+
+	m, err := a.Read()
+	if err != nil {
+		return m, err
+	}
+
+	return m, a.Decode(m, v)
+}
+
+// Decode - unmarshals the data of a received message into the value with the Codec of the connection
+func (a *Actor) Decode(m *Message, v any) error {
+
+	err := a.codec.Unmarshal(m.Data, v)
+	if err != nil {
+		err = errors.New(fmt.Sprintf("unable to unmarshal the message: %s", err))
+		a.logger.Errorf("%s.Decode err: %s", a, err)
+	}
+
+	return err
+}
+
+func getCodec(codec Codec) Codec {
+	if codec == nil {
+		return JSONCodec{}
+	}
+	return codec
+}
@@ -0,0 +1,152 @@
+package ipc
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Compressor - compresses the data of the messages written once the other side has agreed to use
+// a Compressor with the same Name during the handshake. Compression is applied before encryption.
+type Compressor interface {
+	// Name - identifies the compression to the other side of the connection
+	Name() string
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// GzipCompressor - compresses messages with compress/gzip
+type GzipCompressor struct {
+	Level int // the gzip compression level, 0 uses gzip.DefaultCompression
+}
+
+func (GzipCompressor) Name() string {
+	return "gzip"
+}
+
+func (c GzipCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriterLevel(w, compressionLevel(c.Level))
+}
+
+func (GzipCompressor) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// FlateCompressor - compresses messages with compress/flate, which has less overhead than gzip
+type FlateCompressor struct {
+	Level int // the flate compression level, 0 uses flate.DefaultCompression
+}
+
+func (FlateCompressor) Name() string {
+	return "flate"
+}
+
+func (c FlateCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return flate.NewWriter(w, compressionLevel(c.Level))
+}
+
+func (FlateCompressor) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return flate.NewReader(r), nil
+}
+
+func compressionLevel(level int) int {
+	if level == 0 {
+		return flate.DefaultCompression
+	}
+	return level
+}
+
+func getCompressionThreshold(threshold int) int {
+	if threshold <= 0 {
+		return COMPRESSION_THRESHOLD
+	}
+	return threshold
+}
+
+// compressorName - the Name of the Compressor sent in the handshake, empty when compression is disabled
+func compressorName(compressor Compressor) string {
+	if compressor == nil {
+		return ""
+	}
+	return compressor.Name()
+}
+
+// setCompressing - whether the messages of the connection are compressed, agreed during the handshake
+func (a *Actor) setCompressing(compressing bool) {
+	a.mutex.Lock()
+	a.compressing = compressing
+	a.mutex.Unlock()
+}
+
+func (a *Actor) isCompressing() bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.compressing
+}
+
+// compress - a copy of the frame with its data compressed when compression has been agreed, the
+// data is at least the CompressionThreshold and compressing makes it smaller. The frame itself
+// isn't changed as it may be replayed to a connection which doesn't use compression.
+func (a *Actor) compress(f *frame) (*frame, error) {
+
+	if len(f.data) < a.compressionThreshold || !a.isCompressing() {
+		return f, nil
+	}
+
+	var buff bytes.Buffer
+	w, err := a.compressor.NewWriter(&buff)
+	if err == nil {
+		_, err = w.Write(f.data)
+		if closeErr := w.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		return f, errors.New(fmt.Sprintf("unable to compress the message: %s", err))
+	}
+
+	if buff.Len() >= len(f.data) {
+		return f, nil
+	}
+
+	compressed := *f
+	compressed.compressed = true
+	compressed.data = buff.Bytes()
+
+	return &compressed, nil
+}
+
+// decompress - restores the data of a compressed frame, which mustn't exceed the maximum message length
+func (a *Actor) decompress(f *frame) error {
+
+	if !f.compressed {
+		return nil
+	}
+
+	if a.compressor == nil {
+		return errors.New("received a compressed message without a Compressor")
+	}
+
+	r, err := a.compressor.NewReader(bytes.NewReader(f.data))
+	if err != nil {
+		return errors.New(fmt.Sprintf("unable to decompress the message: %s", err))
+	}
+	defer r.Close()
+
+	limit := max(a.getMaxMsgSize(), FRAGMENT_SIZE)
+	data, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return errors.New(fmt.Sprintf("unable to decompress the message: %s", err))
+	}
+	if len(data) > limit {
+		return errors.New("decompressed message exceeds maximum message length")
+	}
+
+	f.data = data
+	f.compressed = false
+
+	return nil
+}
@@ -1,14 +1,21 @@
-//go:build network
-
 package ipc
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"os"
 	"strconv"
 )
 
+// NetworkTransport - connects using TCP unless Network is set, a zero Host or
+// Port is replaced with the IPC_NETWORK_HOST and IPC_NETWORK_PORT defaults
+type NetworkTransport struct {
+	Network string
+	Host    string
+	Port    int
+}
+
 func GetDefaultPort() int {
 	envVar := os.Getenv("IPC_NETWORK_PORT")
 	if len(envVar) > 0 {
@@ -36,28 +43,31 @@ func GetDefaultNetworkType() string {
 	return DEFAULT_NETWORK_TYPE
 }
 
-func getHostAddr(clientId int) string {
-	return fmt.Sprintf("%s:%d", GetDefaultHost(), GetDefaultPort()+clientId)
-}
-
-func (c *Client) connect() (net.Conn, error) {
-
-	conn, err := net.Dial(DEFAULT_NETWORK_TYPE, getHostAddr(c.ClientId))
-	if err != nil {
-		c.logger.Errorf("Dial error: %s", err)
+func (t *NetworkTransport) network() string {
+	if t.Network == "" {
+		return DEFAULT_NETWORK_TYPE
 	}
-
-	return conn, err
+	return t.Network
 }
 
-func (s *Server) listen(clientId int) error {
-
-	listener, err := net.Listen(DEFAULT_NETWORK_TYPE, getHostAddr(clientId))
-	if err != nil {
-		return err
+// Address - the name is ignored, the connection is identified by the host and port
+func (t *NetworkTransport) Address(_ string) string {
+	host := t.Host
+	if host == "" {
+		host = GetDefaultHost()
+	}
+	port := t.Port
+	if port == 0 {
+		port = GetDefaultPort()
 	}
+	return fmt.Sprintf("%s:%d", host, port)
+}
 
-	s.listener = listener
+func (t *NetworkTransport) Dial(ctx context.Context, address string) (net.Conn, error) {
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, t.network(), address)
+}
 
-	return nil
+func (t *NetworkTransport) Listen(address string, _ *ServerConfig) (net.Listener, error) {
+	return net.Listen(t.network(), address)
 }
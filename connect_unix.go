@@ -1,58 +1,51 @@
-//go:build !windows && !network
+//go:build !windows
 
 package ipc
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"os"
-	"strings"
 	"syscall"
 )
 
-func getSocketName(clientId int, name string) string {
-	if clientId > 0 {
-		return fmt.Sprintf("%s%s%d%s", SOCKET_NAME_BASE, name, clientId, SOCKET_NAME_EXT)
-	} else {
-		return fmt.Sprintf("%s%s%s", SOCKET_NAME_BASE, name, SOCKET_NAME_EXT)
-	}
-}
+// UnixTransport - connects using unix domain sockets created in SOCKET_NAME_BASE
+type UnixTransport struct{}
 
-func (c *Client) connect() (net.Conn, error) {
+func platformTransport() Transport {
+	return &UnixTransport{}
+}
 
-	conn, err := net.Dial("unix", getSocketName(c.ClientId, c.config.ClientConfig.Name))
-	//connect: no such file or directory happens a lot when the client connection closes under normal circumstances
-	if err != nil && !strings.Contains(err.Error(), "connect: no such file or directory") &&
-		!strings.Contains(err.Error(), "connect: connection refused") {
-		c.dispatchError(err)
-	}
+func getSocketName(name string) string {
+	return fmt.Sprintf("%s%s%s", SOCKET_NAME_BASE, name, SOCKET_NAME_EXT)
+}
 
-	return conn, err
+func (t *UnixTransport) Address(name string) string {
+	return getSocketName(name)
 }
 
-func (s *Server) listen(clientId int) error {
+func (t *UnixTransport) Dial(ctx context.Context, address string) (net.Conn, error) {
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "unix", address)
+}
 
-	socketName := getSocketName(clientId, s.config.ServerConfig.Name)
+func (t *UnixTransport) Listen(address string, config *ServerConfig) (net.Listener, error) {
 
-	if err := os.RemoveAll(socketName); err != nil {
-		return err
+	if err := os.RemoveAll(address); err != nil {
+		return nil, err
 	}
 
 	var oldUmask int
-	if s.config.ServerConfig.UnmaskPermissions {
+	if config.UnmaskPermissions {
 		oldUmask = syscall.Umask(0)
 	}
 
-	listener, err := net.Listen("unix", socketName)
-	if err != nil {
-		return err
-	}
-
-	s.listener = listener
+	listener, err := net.Listen("unix", address)
 
-	if s.config.ServerConfig.UnmaskPermissions {
+	if config.UnmaskPermissions {
 		syscall.Umask(oldUmask)
 	}
 
-	return nil
+	return listener, err
 }
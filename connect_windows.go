@@ -1,48 +1,39 @@
-//go:build windows && !network
+//go:build windows
 
 package ipc
 
 import (
+	"context"
 	"fmt"
 	"github.com/Microsoft/go-winio"
 	"net"
-	"strings"
 )
 
-func getSocketName(clientId int, name string) string {
-	if clientId > 0 {
-		return fmt.Sprintf("%s%s%d", `\\.\pipe\`, name, clientId)
-	} else {
-		return fmt.Sprintf("%s%s", `\\.\pipe\`, name)
-	}
-}
-
-func (c *Client) connect() (net.Conn, error) {
+// PipeTransport - connects using windows named pipes
+type PipeTransport struct{}
 
-	conn, err := winio.DialPipe(getSocketName(c.ClientId, c.config.ClientConfig.Name), nil)
-
-	if err != nil && !strings.Contains(err.Error(), "the system cannot find the file specified.") {
-		c.dispatchError(err)
-	}
+func platformTransport() Transport {
+	return &PipeTransport{}
+}
 
-	return conn, err
+func getSocketName(name string) string {
+	return fmt.Sprintf("%s%s", `\\.\pipe\`, name)
 }
 
-func (s *Server) listen(clientId int) error {
+func (t *PipeTransport) Address(name string) string {
+	return getSocketName(name)
+}
 
-	socketName := getSocketName(clientId, s.config.ServerConfig.Name)
+func (t *PipeTransport) Dial(ctx context.Context, address string) (net.Conn, error) {
+	return winio.DialPipeContext(ctx, address)
+}
 
-	var config *winio.PipeConfig
-	if s.config.ServerConfig.UnmaskPermissions {
-		config = &winio.PipeConfig{SecurityDescriptor: "D:P(A;;GA;;;AU)"}
-	}
+func (t *PipeTransport) Listen(address string, config *ServerConfig) (net.Listener, error) {
 
-	listener, err := winio.ListenPipe(socketName, config)
-	if err != nil {
-		return err
+	var pipeConfig *winio.PipeConfig
+	if config.UnmaskPermissions {
+		pipeConfig = &winio.PipeConfig{SecurityDescriptor: "D:P(A;;GA;;;AU)"}
 	}
 
-	s.listener = listener
-
-	return nil
+	return winio.ListenPipe(address, pipeConfig)
 }
@@ -0,0 +1,8 @@
+//go:build !network
+
+package ipc
+
+// defaultTransport - used when a Transport isn't provided in the config
+func defaultTransport() Transport {
+	return platformTransport()
+}
@@ -0,0 +1,8 @@
+//go:build network
+
+package ipc
+
+// defaultTransport - building with the network tag makes TCP the default Transport
+func defaultTransport() Transport {
+	return &NetworkTransport{}
+}
@@ -0,0 +1,408 @@
+package ipc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SyncPolicy - when the DurableOutbox flushes the messages appended to its segment file to disk
+type SyncPolicy int
+
+const (
+	// SyncAlways - every message is on disk before the write returns
+	SyncAlways SyncPolicy = iota
+	// SyncPeriodic - the messages are flushed every SyncInterval, those written since may be lost in a crash of the machine
+	SyncPeriodic
+	// SyncNever - the operating system decides when to flush, the messages survive the process crashing but not the machine
+	SyncNever
+)
+
+// DurableOutbox - persists the messages written by a client until the server acknowledges them,
+// those which weren't acknowledged are written again once the client is started after a crash
+type DurableOutbox struct {
+	Dir          string        // the directory of the segment files, which must only be used by a single client
+	Sync         SyncPolicy    // defaults to SyncAlways
+	SyncInterval time.Duration // the interval of SyncPeriodic, defaults to 1 second
+	SegmentSize  int64         // the size of a segment file before a new one is started, defaults to OUTBOX_SEGMENT_SIZE
+}
+
+const (
+	recordMessage byte = 1 // a message written by the client
+	recordAck     byte = 2 // the messages up to the id have been acknowledged by the server
+	recordDrop    byte = 3 // the message of the id was discarded before it was sent
+)
+
+// recordHeaderLen - the length of the record (4 bytes) followed by its crc32 checksum (4 bytes)
+const recordHeaderLen = 8
+
+// durableSegment - an append-only file of records, removed once its messages have been acknowledged
+type durableSegment struct {
+	path   string
+	lastId uint64 // the id of the last message in the segment
+}
+
+// durableOutbox - the segment files of a DurableOutbox, each message is given an id which
+// continues from the last one persisted
+type durableOutbox struct {
+	mutex    sync.Mutex
+	config   DurableOutbox
+	segments []*durableSegment // the last segment is the one being appended to
+	file     *os.File
+	size     int64
+	lastId   uint64
+	acked    uint64
+	pending  []*frame // the messages which haven't been acknowledged, in the order they were written
+	syncing  bool     // a SyncPeriodic flush has been scheduled
+	closed   bool
+}
+
+func openDurableOutbox(config DurableOutbox) (*durableOutbox, error) {
+
+	if config.Dir == "" {
+		return nil, errors.New("the DurableOutbox requires a Dir")
+	}
+	if config.SyncInterval <= 0 {
+		config.SyncInterval = time.Second
+	}
+	if config.SegmentSize <= 0 {
+		config.SegmentSize = OUTBOX_SEGMENT_SIZE
+	}
+
+	err := os.MkdirAll(config.Dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	o := &durableOutbox{config: config}
+
+	paths, err := filepath.Glob(filepath.Join(config.Dir, "*.seg"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	for i, path := range paths {
+		err = o.load(path, i == len(paths)-1)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	pending := o.pending[:0]
+	for _, f := range o.pending {
+		if f.outboxId > o.acked {
+			pending = append(pending, f)
+		}
+	}
+	o.pending = pending
+
+	if len(o.segments) == 0 {
+		err = o.rotate()
+	} else {
+		o.file, err = os.OpenFile(o.segments[len(o.segments)-1].path, os.O_WRONLY|os.O_APPEND, 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	o.trim()
+
+	return o, nil
+}
+
+// load - reads the records of a segment, the last segment is truncated after its last complete
+// record as the process may have crashed while appending to it
+func (o *durableOutbox) load(path string, last bool) error {
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	segment := &durableSegment{path: path}
+	offset := 0
+
+	for len(b)-offset >= recordHeaderLen {
+
+		n := int(binary.BigEndian.Uint32(b[offset:]))
+		sum := binary.BigEndian.Uint32(b[offset+4:])
+		if n < 9 || len(b)-offset-recordHeaderLen < n {
+			break
+		}
+
+		record := b[offset+recordHeaderLen : offset+recordHeaderLen+n]
+		if crc32.ChecksumIEEE(record) != sum {
+			break
+		}
+		offset += recordHeaderLen + n
+
+		id := binary.BigEndian.Uint64(record[1:9])
+		switch record[0] {
+		case recordMessage:
+			if len(record) < 18 {
+				return errors.New(fmt.Sprintf("the outbox segment %s has a malformed message", path))
+			}
+			o.pending = append(o.pending, &frame{
+				msgType:   int(binary.BigEndian.Uint32(record[9:13])),
+				flags:     record[13],
+				requestId: binary.BigEndian.Uint32(record[14:18]),
+				data:      record[18:],
+				outboxId:  id,
+			})
+			o.lastId = max(o.lastId, id)
+			segment.lastId = id
+		case recordAck:
+			o.acked = max(o.acked, id)
+		case recordDrop:
+			o.remove(id)
+		}
+	}
+
+	if offset < len(b) {
+		if !last {
+			return errors.New(fmt.Sprintf("the outbox segment %s is corrupt", path))
+		}
+		err = os.Truncate(path, int64(offset))
+		if err != nil {
+			return err
+		}
+	}
+
+	o.segments = append(o.segments, segment)
+	o.size = int64(offset)
+
+	return nil
+}
+
+// append - persists a message written by the client, giving it the next id
+func (o *durableOutbox) append(f *frame) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if o.closed {
+		return errors.New("the outbox has been closed")
+	}
+
+	o.lastId++
+	record := make([]byte, 18, 18+len(f.data))
+	record[0] = recordMessage
+	binary.BigEndian.PutUint64(record[1:], o.lastId)
+	binary.BigEndian.PutUint32(record[9:], uint32(f.msgType))
+	record[13] = f.flags
+	binary.BigEndian.PutUint32(record[14:], f.requestId)
+
+	//the segment may be full once the message has been appended to it
+	segment := o.segments[len(o.segments)-1]
+	segment.lastId = o.lastId
+
+	err := o.write(append(record, f.data...), true)
+	if err != nil {
+		return err
+	}
+
+	f.outboxId = o.lastId
+	o.pending = append(o.pending, f)
+
+	return nil
+}
+
+// ack - records the messages up to the id have been acknowledged, removing the segments which
+// only contain acknowledged messages
+func (o *durableOutbox) ack(id uint64) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if o.closed || id <= o.acked {
+		return nil
+	}
+
+	o.acked = id
+
+	record := make([]byte, 9)
+	record[0] = recordAck
+	binary.BigEndian.PutUint64(record[1:], id)
+
+	//a lost acknowledgement only results in the message being written again
+	err := o.write(record, false)
+	if err != nil {
+		return err
+	}
+
+	n := 0
+	for n < len(o.pending) && o.pending[n].outboxId <= id {
+		o.pending[n] = nil
+		n++
+	}
+	o.pending = o.pending[n:]
+
+	o.trim()
+
+	return nil
+}
+
+// drop - records the message of the id was discarded before it was sent, so it isn't written
+// again once the client is started after a crash
+func (o *durableOutbox) drop(id uint64) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if o.closed || id <= o.acked {
+		return nil
+	}
+
+	record := make([]byte, 9)
+	record[0] = recordDrop
+	binary.BigEndian.PutUint64(record[1:], id)
+
+	err := o.write(record, true)
+	if err != nil {
+		return err
+	}
+
+	o.remove(id)
+
+	return nil
+}
+
+// remove - discards the pending message of the id
+func (o *durableOutbox) remove(id uint64) {
+	for i, f := range o.pending {
+		if f.outboxId == id {
+			o.pending = append(o.pending[:i], o.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+// write - appends a record to the current segment, starting a new segment once it is full
+func (o *durableOutbox) write(record []byte, sync bool) error {
+
+	b := make([]byte, recordHeaderLen, recordHeaderLen+len(record))
+	binary.BigEndian.PutUint32(b, uint32(len(record)))
+	binary.BigEndian.PutUint32(b[4:], crc32.ChecksumIEEE(record))
+
+	n, err := o.file.Write(append(b, record...))
+	o.size += int64(n)
+	if err != nil {
+		return err
+	}
+
+	if sync {
+		switch o.config.Sync {
+		case SyncAlways:
+			err = o.file.Sync()
+		case SyncPeriodic:
+			o.scheduleSync()
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if o.size >= o.config.SegmentSize {
+		return o.rotate()
+	}
+
+	return nil
+}
+
+func (o *durableOutbox) scheduleSync() {
+
+	if o.syncing {
+		return
+	}
+	o.syncing = true
+
+	time.AfterFunc(o.config.SyncInterval, func() {
+		o.mutex.Lock()
+		defer o.mutex.Unlock()
+
+		o.syncing = false
+		if !o.closed {
+			o.file.Sync()
+		}
+	})
+}
+
+// rotate - starts a new segment named after the next id, which begins with the last
+// acknowledgement so it isn't lost when the previous segments are removed
+func (o *durableOutbox) rotate() error {
+
+	if o.file != nil {
+		err := o.file.Sync()
+		if err == nil {
+			err = o.file.Close()
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	path := filepath.Join(o.config.Dir, fmt.Sprintf("%020d.seg", o.lastId+1))
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	o.file = file
+	o.size = 0
+	o.segments = append(o.segments, &durableSegment{path: path})
+
+	if o.acked > 0 {
+		record := make([]byte, 9)
+		record[0] = recordAck
+		binary.BigEndian.PutUint64(record[1:], o.acked)
+		return o.write(record, false)
+	}
+
+	return nil
+}
+
+// trim - removes the segments before the current one whose messages have all been acknowledged
+func (o *durableOutbox) trim() {
+
+	for len(o.segments) > 1 && o.segments[0].lastId <= o.acked {
+		err := os.Remove(o.segments[0].path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return
+		}
+		o.segments = o.segments[1:]
+	}
+}
+
+// frames - copies of the messages which haven't been acknowledged, to be written in a new session
+func (o *durableOutbox) frames() []*frame {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	frames := make([]*frame, len(o.pending))
+	for i, f := range o.pending {
+		frames[i] = &frame{msgType: f.msgType, flags: f.flags, requestId: f.requestId, data: f.data, outboxId: f.outboxId}
+	}
+
+	return frames
+}
+
+func (o *durableOutbox) close() error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if o.closed {
+		return nil
+	}
+	o.closed = true
+
+	err := o.file.Sync()
+	if closeErr := o.file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
@@ -7,13 +7,19 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/binary"
 	"errors"
 	"fmt"
-	"io"
+	"math"
 	"net"
+	"sync"
 )
 
+// shouldUseEncryption - whether the built-in encryption is used, TLS replaces it
 func (a *Actor) shouldUseEncryption() bool {
+	if a.usesTLS() {
+		return false
+	}
 	if a.config.IsServer {
 		return a.config.ServerConfig.Encryption
 	} else {
@@ -49,21 +55,23 @@ func (cc *Actor) keyExchange() ([32]byte, error) {
 	return shared, nil
 }
 
-func (sc *Actor) startEncryption() error {
+// startEncryption - returns the shared secret of the key exchange, which authenticate binds its proofs to
+func (sc *Actor) startEncryption() ([32]byte, error) {
 
 	shared, err := sc.keyExchange()
 	if err != nil {
-		return err
+		return shared, err
 	}
 
 	gcm, err := createCipher(shared)
 	if err != nil {
-		return err
+		return shared, err
 	}
 
 	sc.cipher = gcm
+	sc.nonces.reset()
 
-	return nil
+	return shared, nil
 }
 
 func generateKeys() (*ecdsa.PrivateKey, *ecdsa.PublicKey, error) {
@@ -152,27 +160,96 @@ func createCipher(shared [32]byte) (*cipher.AEAD, error) {
 	return &gcm, nil
 }
 
-func encrypt(g cipher.AEAD, data []byte) ([]byte, error) {
+// the security errors dispatched when an encrypted message can't be trusted
+var (
+	// ErrReplayedFrame - a message which has already been received, it is discarded
+	ErrReplayedFrame = errors.New("received a replayed frame")
+	// ErrReorderedFrame - a message received ahead of one which hasn't been, the connection is closed
+	ErrReorderedFrame = errors.New("received a frame out of order")
+	// ErrTamperedFrame - a message which failed to decrypt, the connection is closed
+	ErrTamperedFrame = errors.New("received a frame which failed authentication")
+)
+
+const (
+	nonceServer uint32 = 1 // the nonces of the messages written by the server
+	nonceClient uint32 = 2 // the nonces of the messages written by the client
+)
 
-	nonce := make([]byte, g.NonceSize())
+// nonceCounters - the messages encrypted on a connection are numbered, their number is used as
+// the nonce so a message which is replayed or reordered by someone on the connection is detected.
+// Each side uses its own range of nonces as both directions are encrypted with the same key.
+type nonceCounters struct {
+	mutex    sync.Mutex
+	sent     uint64
+	received uint64
+}
 
-	_, err := io.ReadFull(rand.Reader, nonce)
+// reset - starts numbering the messages of a new key exchange
+func (nc *nonceCounters) reset() {
+	nc.mutex.Lock()
+	nc.sent = 0
+	nc.received = 0
+	nc.mutex.Unlock()
+}
 
-	return g.Seal(nonce, nonce, data, nil), err
+func nonce(g cipher.AEAD, direction uint32, counter uint64) []byte {
+	n := make([]byte, g.NonceSize())
+	binary.BigEndian.PutUint32(n, direction)
+	binary.BigEndian.PutUint64(n[len(n)-8:], counter)
+	return n
 }
 
-func decrypt(g cipher.AEAD, recdData []byte) ([]byte, error) {
+// encrypt - the number of the message (8 bytes) followed by the message encrypted with it as the nonce
+func (a *Actor) encrypt(data []byte) ([]byte, error) {
+
+	g := *a.cipher
+	direction := nonceClient
+	if a.config.IsServer {
+		direction = nonceServer
+	}
+
+	a.nonces.mutex.Lock()
+	defer a.nonces.mutex.Unlock()
 
-	nonceSize := g.NonceSize()
-	if len(recdData) < nonceSize {
-		return nil, errors.New("not enough data to decrypt")
+	if a.nonces.sent == math.MaxUint64 {
+		return nil, errors.New("the nonces of the connection have been exhausted")
 	}
+	a.nonces.sent++
 
-	nonce, recdData := recdData[:nonceSize], recdData[nonceSize:]
-	plain, err := g.Open(nil, nonce, recdData, nil)
+	buff := make([]byte, 8, 8+len(data)+g.Overhead())
+	binary.BigEndian.PutUint64(buff, a.nonces.sent)
+
+	return g.Seal(buff, nonce(g, direction, a.nonces.sent), data, nil), nil
+}
+
+// decrypt - accepts the messages of the other side in the order they were numbered
+func (a *Actor) decrypt(data []byte) ([]byte, error) {
+
+	g := *a.cipher
+	direction := nonceServer
+	if a.config.IsServer {
+		direction = nonceClient
+	}
+
+	if len(data) < 8 {
+		return nil, ErrTamperedFrame
+	}
+	counter := binary.BigEndian.Uint64(data)
+
+	a.nonces.mutex.Lock()
+	defer a.nonces.mutex.Unlock()
+
+	if counter <= a.nonces.received {
+		return nil, ErrReplayedFrame
+	} else if counter != a.nonces.received+1 {
+		return nil, ErrReorderedFrame
+	}
+
+	plain, err := g.Open(nil, nonce(g, direction, counter), data[8:], nil)
 	if err != nil {
-		return nil, err
+		return nil, ErrTamperedFrame
 	}
+	a.nonces.received = counter
 
 	return plain, nil
 }
@@ -0,0 +1,84 @@
+package ipc
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Event - a change in the status of the connection or an error, delivered by Events
+type Event struct {
+	Status   Status // the status of the connection when the event was dispatched
+	Err      error  // set when the event is an error rather than a change in status
+	ClientId int    // the ClientId of the connection the event was dispatched by
+}
+
+func (e *Event) String() string {
+	if e.Err != nil {
+		return fmt.Sprintf("Event(%d)(%s)(err: %s)", e.ClientId, e.Status, e.Err)
+	}
+	return fmt.Sprintf("Event(%d)(%s)", e.ClientId, e.Status)
+}
+
+// Events - the status changes and errors of the connection. The channel is buffered and
+// independent of Read, when it is full the oldest event is discarded so a consumer which
+// doesn't read events never blocks the connection. The Events of a MultiClient server also
+// contain the Events of each of its Connections.
+func (a *Actor) Events() <-chan *Event {
+	return a.events
+}
+
+func (a *Actor) dispatchEvent(e *Event) {
+
+	if a.serverRef != nil && a.serverRef.pool != nil {
+		a.serverRef.pool.server.dispatchEvent(e)
+	}
+
+	a.eventMutex.Lock()
+	defer a.eventMutex.Unlock()
+
+	for {
+		select {
+		case a.events <- e:
+			return
+		default:
+			select {
+			case dropped := <-a.events:
+				a.logger.Debugf("%s.dispatchEvent discarded %s", a, dropped)
+			default:
+			}
+		}
+	}
+}
+
+func (a *Actor) dispatchStatus(status Status) {
+	a.logger.Debugf("Actor.dispatchStatus(%s): %s", a, status)
+	a.setStatus(status)
+	a.dispatchEvent(&Event{Status: status, ClientId: a.clientId()})
+}
+
+func (a *Actor) dispatchError(err error) {
+	a.logger.Debugf("Actor.dispatchError(%s): %s", a, err)
+	a.dispatchEvent(&Event{Status: a.getStatus(), Err: err, ClientId: a.clientId()})
+}
+
+func (a *Actor) dispatchErrorStr(err string) {
+	a.dispatchError(errors.New(err))
+}
+
+// clientId - the ClientId of the client or client server the Actor belongs to
+func (a *Actor) clientId() int {
+	if a.serverRef != nil {
+		return a.serverRef.ClientId
+	} else if a.clientRef != nil {
+		return a.clientRef.ClientId
+	}
+	return 0
+}
+
+// terminate - unblocks Read and stops writing once the connection won't be used again
+func (a *Actor) terminate() {
+	a.closeOnce.Do(func() {
+		close(a.received)
+		close(a.done)
+	})
+}
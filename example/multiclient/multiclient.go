@@ -79,36 +79,25 @@ func serverPonger(c *ipc.Client, autosend bool) {
 
 	for {
 
+		if c.StatusCode() == ipc.ReConnecting {
+			panic("Reconnecting")
+		}
+
 		message, err := c.ReadTimed(5 * time.Second)
 
 		if message == ipc.TimeoutMessage {
 			continue
 		} else if err != nil {
 			log.Println("Client Read err: ", err)
-			if err.Error() == "Client.Read timed out" {
-				panic(err)
-			}
-			continue
+			return
 		}
 
-		if message.MsgType == -1 { //internal message
-
-			log.Println("client status", c.Status())
-
-			if message.Status == "Reconnecting" {
-				panic("Reconnecting")
-			}
-
-		} else { //user message
-			log.Printf("Client(%d) received: %s - Message type: %d", c.ClientId, string(message.Data), message.MsgType)
-			err2 := c.Write(5, []byte(pongMessage))
-			if err2 != nil {
-				log.Println("Client Write  err: ", err)
-			}
-			break
+		log.Printf("Client(%d) received: %s - Message type: %d", c.ClientId, string(message.Data), message.MsgType)
+		err2 := c.Write(5, []byte(pongMessage))
+		if err2 != nil {
+			log.Println("Client Write  err: ", err2)
 		}
-
-		ipc.Sleep()
+		return
 	}
 
 }
@@ -123,6 +112,26 @@ func server() *ipc.Server {
 	startTime := time.Now()
 	useFastest := os.Getenv("FAST") == "true"
 
+	// the events of every client connection are dispatched on the server
+	go func() {
+		for {
+			event := <-s.Events()
+
+			if event.Err != nil {
+				log.Println("server err: ", event.Err)
+			} else if event.Status == ipc.Connected {
+				s.Connections.MapExec(func(srv *ipc.Server) {
+					if srv.ClientId == event.ClientId {
+						log.Println("server sending ping: status", srv.Status())
+						srv.Write(1, []byte("server - PING"))
+					}
+				}, "ping")
+			} else if event.Status == ipc.Closed && event.ClientId == 0 {
+				return
+			}
+		}
+	}()
+
 	go func() {
 		for {
 
@@ -148,17 +157,5 @@ func onReadTimedFinish(srv *ipc.Server, message *ipc.Message, err error) {
 		return
 	}
 
-	if message.MsgType == -1 { //internal message
-
-		log.Println("server status", srv.Status())
-
-		if message.Status == "Connected" {
-			log.Println("server sending ping: status", srv.Status())
-			srv.Write(1, []byte("server - PING"))
-		}
-
-	} else { //user message
-
-		log.Println("Server received: "+string(message.Data)+" - Message type: ", message.MsgType)
-	}
+	log.Println("Server received: "+string(message.Data)+" - Message type: ", message.MsgType)
 }
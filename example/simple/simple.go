@@ -34,37 +34,27 @@ func serverPonger(c *ipc.Client) {
 
 	for {
 
-		message, err := c.Read()
+		event := <-c.Events()
 
-		if err != nil {
-			log.Println("Read err: ", err)
-			if err.Error() == "Client.Read timed out" {
-				panic(err)
-			}
-			continue
-		}
-
-		//internal message
-		if message.MsgType == -1 {
-
-			log.Println("client status", c.Status())
-
-			if message.Status == "Reconnecting" {
-				panic(message.Status)
-			} else if message.Status == "Connected" {
-				c.Write(5, []byte(pongMessage))
-			}
-
-			//user message
-		} else {
+		log.Println("client status", c.Status())
 
-			log.Printf("Client(%d) received: %s - Message type: %d", c.ClientId, string(message.Data), message.MsgType)
+		if event.Err != nil {
+			log.Println("client err: ", event.Err)
+		} else if event.Status == ipc.ReConnecting {
+			panic(event.Status)
+		} else if event.Status == ipc.Connected {
+			c.Write(5, []byte(pongMessage))
 			break
 		}
+	}
 
-		ipc.Sleep()
+	message, err := c.Read()
+	if err != nil {
+		log.Println("Read err: ", err)
+		return
 	}
 
+	log.Printf("Client(%d) received: %s - Message type: %d", c.ClientId, string(message.Data), message.MsgType)
 }
 
 func server() *ipc.Server {
@@ -76,31 +66,31 @@ func server() *ipc.Server {
 
 	go func() {
 		for {
-			msg, err2 := s.Read()
-			if err2 != nil {
-				log.Println("Server Read err: ", err2)
-				continue
-			}
+			event := <-s.Events()
 
-			//internal message
-			if msg.MsgType == -1 {
+			if event.Err != nil {
+				log.Println("server err: ", event.Err)
+			} else if event.Status == ipc.Connected {
 
-				if msg.Status == "Connected" {
-
-					log.Println("server sending ping: status", s.Status())
-					s.Write(1, []byte("server - PING"))
-
-				} else if msg.Status == "Closed" {
-					return
-				}
+				log.Println("server sending ping: status", s.Status())
+				s.Write(1, []byte("server - PING"))
 
-				//user message
-			} else {
+			} else if event.Status == ipc.Closed {
+				return
+			}
+		}
+	}()
 
-				log.Println("Server received: "+string(msg.Data)+" - Message type: ", msg.MsgType)
-				s.Write(1, []byte("server - PING"))
+	go func() {
+		for {
+			msg, err2 := s.Read()
+			if err2 != nil {
+				log.Println("Server Read err: ", err2)
+				return
 			}
 
+			log.Println("Server received: "+string(msg.Data)+" - Message type: ", msg.MsgType)
+			s.Write(1, []byte("server - PING"))
 		}
 	}()
 
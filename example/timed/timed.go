@@ -33,41 +33,42 @@ func serverPonger(c *ipc.Client) {
 
 	pongMessage := fmt.Sprintf("Message from client(%d) - PONG", c.ClientId)
 
-	for {
-
-		message, err := c.ReadTimed(time.Second * 5)
-
-		if message == ipc.TimeoutMessage {
-			continue
-		} else if err != nil {
-			log.Println("Read err: ", err)
-			//this happens in rare edge cases when the client attempts to connect too fast after server is listening
-			if err.Error() == "Client.Read timed out" {
-				panic(err)
-			}
-			continue
-		}
+	for connected := false; !connected; {
 
-		if message.MsgType == -1 {
+		select {
+		case event := <-c.Events():
 
 			log.Println("client status", c.Status())
 
-			if message.Status == "Reconnecting" {
+			if event.Err != nil {
+				log.Println("client err: ", event.Err)
+			} else if event.Status == ipc.ReConnecting {
 				c.Close()
 				return
-			} else if message.Status == "Connected" {
+			} else if event.Status == ipc.Connected {
 				c.Write(5, []byte(pongMessage))
+				connected = true
 			}
 
-		} else {
+		case <-time.After(time.Second * 5):
+			log.Println("client is waiting to connect: status", c.Status())
+		}
+	}
+
+	for {
+
+		message, err := c.ReadTimed(time.Second * 5)
 
-			log.Printf("Client(%d) received: %s - Message type: %d", c.ClientId, string(message.Data), message.MsgType)
-			break
+		if message == ipc.TimeoutMessage {
+			continue
+		} else if err != nil {
+			log.Println("Read err: ", err)
+			return
 		}
 
-		ipc.Sleep()
+		log.Printf("Client(%d) received: %s - Message type: %d", c.ClientId, string(message.Data), message.MsgType)
+		break
 	}
-
 }
 
 func server() *ipc.Server {
@@ -77,6 +78,24 @@ func server() *ipc.Server {
 		panic(err)
 	}
 
+	go func() {
+		for {
+			event := <-s.Events()
+
+			log.Printf("Server status: %s", s.Status())
+
+			if event.Err != nil {
+				log.Println("Server err: ", event.Err)
+			} else if event.Status == ipc.Connected {
+
+				log.Println("server sending ping: status", s.Status())
+				s.Write(1, []byte("server - PING"))
+			} else if event.Status == ipc.Closed {
+				return
+			}
+		}
+	}()
+
 	go func() {
 		for {
 			msg, err2 := s.ReadTimed(time.Second * 5)
@@ -84,29 +103,12 @@ func server() *ipc.Server {
 			if msg == ipc.TimeoutMessage {
 				continue
 			} else if err2 != nil {
-				log.Println("Server Read err: ", err)
-				continue
+				log.Println("Server Read err: ", err2)
+				return
 			}
 
-			//internal message
-			if msg.MsgType == -1 {
-
-				log.Printf("Server status: %s", s.Status())
-
-				if msg.Status == "Connected" {
-
-					log.Println("server sending ping: status", s.Status())
-					s.Write(1, []byte("server - PING"))
-				} else if msg.Status == "Closed" {
-					return
-				}
-
-				//user message
-			} else {
-
-				log.Println("Server received: "+string(msg.Data)+" - Message type: ", msg.MsgType)
-				s.Write(1, []byte("server - PING"))
-			}
+			log.Println("Server received: "+string(msg.Data)+" - Message type: ", msg.MsgType)
+			s.Write(1, []byte("server - PING"))
 		}
 	}()
 
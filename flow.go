@@ -0,0 +1,197 @@
+package ipc
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"sync"
+)
+
+// FlowPolicy - what a write does when the other side has fallen behind and its receive window is full
+type FlowPolicy int
+
+const (
+	// FlowBlock - the write waits until the other side reads a message or its context is done
+	FlowBlock FlowPolicy = iota
+	// FlowError - the write returns an error straight away
+	FlowError
+	// FlowDrop - the message is discarded, counted in the Dropped Stats and ErrDropped is returned
+	FlowDrop
+)
+
+// ErrDropped - returned by a write which FlowDrop discarded as the receive window of the other side is full
+var ErrDropped = errors.New("the message was dropped as the receive window of the other side is full")
+
+// Stats - the depth of the queues of a connection
+type Stats struct {
+	Received      int    // the messages received which are waiting to be read
+	ReceiveBuffer int    // the capacity of the received queue, which is also the window granted to the other side
+	Sending       int    // the messages queued to be written to the connection, of every Priority
+	SendBuffer    int    // the capacity of the sending queue of each Priority
+	Credits       int    // the messages which can be written before the other side reads some, when it has a window
+	Window        int    // the receive window of the other side, 0 when it doesn't limit the messages written to it
+	Dropped       uint64 // the messages discarded by FlowDrop
+}
+
+// flowControl - credit based flow control, each side grants the other a window of messages it
+// will buffer and grants credits back as the messages are read, so a slow reader stops the writer
+// rather than the connection
+type flowControl struct {
+	mutex        sync.Mutex
+	policy       FlowPolicy
+	ownWindow    int           // the ReceiveBuffer granted to the other side
+	window       int           // the window granted by the other side
+	credits      int           // the messages which can be written to the other side
+	granted      chan struct{} // closed and replaced when credits are granted, to wake blocked writes
+	consumed     int           // the messages read which haven't been granted back to the other side
+	creditNeeded chan struct{} // signals the writer to grant credits to the other side
+	dropped      uint64
+}
+
+func newFlowControl(ownWindow int, policy FlowPolicy) *flowControl {
+	return &flowControl{
+		policy:       policy,
+		ownWindow:    ownWindow,
+		granted:      make(chan struct{}),
+		creditNeeded: make(chan struct{}, 1),
+	}
+}
+
+// credited - whether the frame uses the window of the other side. Responses are consumed as soon
+// as they are received and streams are limited by STREAM_BUFFER_SIZE instead.
+func (f *frame) credited() bool {
+	return f.msgType != 0 && f.flags&(frameChunk|frameStreamEnd|frameResponse) == 0
+}
+
+// reset - starts a new connection with the window granted by the other side in the handshake
+func (fc *flowControl) reset(window int) {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+
+	fc.window = window
+	fc.credits = window
+	fc.consumed = 0
+	close(fc.granted)
+	fc.granted = make(chan struct{})
+}
+
+// acquire - takes a credit to write the frame, returns false when the frame is dropped
+func (fc *flowControl) acquire(ctx context.Context, done chan struct{}) (bool, error) {
+	return fc.acquireWith(ctx, done, fc.policy)
+}
+
+// acquireWith - uses a credit following the policy rather than the FlowPolicy of the config
+func (fc *flowControl) acquireWith(ctx context.Context, done chan struct{}, policy FlowPolicy) (bool, error) {
+
+	for {
+		fc.mutex.Lock()
+
+		if fc.window == 0 || fc.credits > 0 {
+			if fc.window > 0 {
+				fc.credits--
+			}
+			fc.mutex.Unlock()
+			return true, nil
+		}
+
+		switch policy {
+		case FlowError:
+			fc.mutex.Unlock()
+			return false, errors.New("the receive window of the other side is full")
+		case FlowDrop:
+			fc.dropped++
+			fc.mutex.Unlock()
+			return false, nil
+		}
+
+		granted := fc.granted
+		fc.mutex.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-done:
+			return false, errors.New("the connection has been closed")
+		case <-granted:
+		}
+	}
+}
+
+// tryAcquire - uses a credit when one is available whatever the FlowPolicy, otherwise returns the
+// channel closed once credits are granted
+func (fc *flowControl) tryAcquire() (bool, chan struct{}) {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+
+	if fc.window == 0 || fc.credits > 0 {
+		if fc.window > 0 {
+			fc.credits--
+		}
+		return true, nil
+	}
+
+	return false, fc.granted
+}
+
+// grant - the other side has read messages, so more can be written to it
+func (fc *flowControl) grant(credits int) {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+
+	fc.credits = min(fc.credits+credits, fc.window)
+	close(fc.granted)
+	fc.granted = make(chan struct{})
+}
+
+// consume - a message has been read, the credits are granted back once half the window has been read
+func (fc *flowControl) consume() {
+
+	if fc == nil || fc.ownWindow == 0 {
+		return
+	}
+
+	fc.mutex.Lock()
+	fc.consumed++
+	needed := fc.consumed >= max(1, fc.ownWindow/2)
+	fc.mutex.Unlock()
+
+	if needed {
+		select {
+		case fc.creditNeeded <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// creditFrame - the control frame granting the messages read back to the other side
+func (fc *flowControl) creditFrame() *frame {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+
+	if fc.consumed == 0 {
+		return nil
+	}
+
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, uint32(fc.consumed))
+	fc.consumed = 0
+
+	return &frame{flags: frameCredit, data: data}
+}
+
+// Stats - returns the depth of the queues of the connection
+func (a *Actor) Stats() Stats {
+
+	a.flow.mutex.Lock()
+	defer a.flow.mutex.Unlock()
+
+	return Stats{
+		Received:      len(a.received),
+		ReceiveBuffer: cap(a.received),
+		Sending:       len(a.toWrite) + len(a.toWriteHigh) + len(a.toWriteLow),
+		SendBuffer:    cap(a.toWrite),
+		Credits:       a.flow.credits,
+		Window:        a.flow.window,
+		Dropped:       a.flow.dropped,
+	}
+}
@@ -0,0 +1,86 @@
+package ipc
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	frameRequest   byte = 1 << iota // the frame is a request made with Client.Call
+	frameResponse                   // the frame is the response to a request
+	frameError                      // the response data contains the error returned by the CallHandler
+	frameChunk                      // the frame is a chunk of the stream identified by the requestId
+	frameStreamEnd                  // the frame ends the stream, the data contains its length and checksum
+	frameConn                       // the control frame contains data for the net.Conn returned by NetConn
+	frameHeartbeat                  // the control frame shows the other side is alive
+	frameCredit                     // the control frame grants the number of messages in its data back to the writer
+)
+
+// frameHeaderLen - msgType (4 bytes), flags (1 byte), requestId (4 bytes), seq (4 bytes), ack (4 bytes), fragment (1 byte),
+// compressed (1 byte)
+const frameHeaderLen = 19
+
+// frame - what is written to the connection for each message, encrypted as a whole when
+// encryption is enabled and prefixed with its length
+type frame struct {
+	msgType    int
+	flags      byte
+	requestId  uint32
+	seq        uint32 // numbers the messages of a session, 0 for the frames which aren't replayed
+	ack        uint32 // the seq of the last message received from the other side
+	outboxId   uint64 // the id of the message in the DurableOutbox of the client, 0 when it isn't persisted
+	fragment   byte   // the lane of a frame written in fragments along with fragmentMore, 0 for a whole frame
+	compressed bool   // the data has been compressed with the Compressor agreed in the handshake
+	priority   Priority
+	data       []byte
+}
+
+func (f *frame) encode() []byte {
+
+	b := make([]byte, frameHeaderLen, frameHeaderLen+len(f.data))
+	binary.BigEndian.PutUint32(b, uint32(f.msgType))
+	b[4] = f.flags
+	binary.BigEndian.PutUint32(b[5:], f.requestId)
+	binary.BigEndian.PutUint32(b[9:], f.seq)
+	binary.BigEndian.PutUint32(b[13:], f.ack)
+	b[17] = f.fragment
+	if f.compressed {
+		b[18] = 1
+	}
+
+	return append(b, f.data...)
+}
+
+func decodeFrame(b []byte) (*frame, error) {
+
+	if len(b) < frameHeaderLen {
+		return nil, errors.New("received a frame shorter than the frame header")
+	}
+
+	return &frame{
+		msgType:    bytesToInt(b[:4]),
+		flags:      b[4],
+		requestId:  binary.BigEndian.Uint32(b[5:9]),
+		seq:        binary.BigEndian.Uint32(b[9:13]),
+		ack:        binary.BigEndian.Uint32(b[13:17]),
+		fragment:   b[17],
+		compressed: b[18] == 1,
+		data:       b[frameHeaderLen:],
+	}, nil
+}
+
+// sequenced - whether the frame is numbered and replayed when the session is resumed, control
+// frames aren't and streams and the NetConn end with the connection
+func (f *frame) sequenced() bool {
+	return f.msgType != 0 && f.flags&(frameChunk|frameStreamEnd) == 0
+}
+
+func (f *frame) toMessage() *Message {
+
+	m := &Message{MsgType: f.msgType, Data: f.data, RequestId: f.requestId}
+	if f.flags&frameError != 0 {
+		m.Err = errors.New(string(f.data))
+	}
+
+	return m
+}
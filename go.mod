@@ -5,6 +5,5 @@ go 1.21
 require (
 	github.com/Microsoft/go-winio v0.6.2
 	github.com/sirupsen/logrus v1.9.3
+	golang.org/x/sys v0.10.0
 )
-
-require golang.org/x/sys v0.10.0 // indirect
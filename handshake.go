@@ -1,22 +1,56 @@
 package ipc
 
 import (
-	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"time"
 )
 
 // 1st message sent from the server
 // byte 0 = protocol VERSION no.
+// byte 1 = 0 without encryption, 1 with encryption, 2 when the client is rejected
+// byte 2 = 1 when the client must authenticate with a pre-shared key
 func (sc *Server) handshake() error {
 
-	err := sc.one()
+	var shared [32]byte
+	var err error
+	if sc.usesTLS() {
+		shared, err = sc.startTLS()
+		if err != nil {
+			return err
+		}
+	}
+
+	err = sc.one()
 	if err != nil {
 		return err
 	}
 
 	if sc.shouldUseEncryption() {
-		err = sc.startEncryption()
+		shared, err = sc.startEncryption()
+		if err != nil {
+			return err
+		}
+	}
+
+	if sc.shouldUseEncryption() || sc.usesTLS() {
+		err = sc.identify(shared[:])
+		if err != nil {
+			return err
+		}
+	} else if sc.usesIdentity() {
+		return errors.New("identity keys require encryption or tls")
+	}
+
+	if sc.requiresPreSharedKey() {
+		//without a shared secret the proofs would be sent in the clear
+		if !sc.shouldUseEncryption() && !sc.usesTLS() {
+			return errors.New("pre-shared keys require encryption or tls")
+		}
+		err = sc.authenticate(shared[:])
 		if err != nil {
 			return err
 		}
@@ -27,12 +61,35 @@ func (sc *Server) handshake() error {
 		return err
 	}
 
+	err = sc.options()
+	if err != nil {
+		return err
+	}
+
+	err = sc.resume()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// reject - sends the 1st message telling the client the server won't accept any more clients
+func (sc *Server) reject() error {
+
+	buff := []byte{byte(VERSION), 2, 0}
+
+	_, err := sc.getConn().Write(buff)
+	if err != nil {
+		return errors.New("unable to send handshake ")
+	}
+
 	return nil
 }
 
 func (sc *Server) one() error {
 
-	buff := make([]byte, 2)
+	buff := make([]byte, 3)
 
 	buff[0] = byte(VERSION)
 
@@ -42,6 +99,10 @@ func (sc *Server) one() error {
 		buff[1] = byte(0)
 	}
 
+	if sc.requiresPreSharedKey() {
+		buff[2] = byte(1)
+	}
+
 	_, err := sc.getConn().Write(buff)
 	if err != nil {
 		return errors.New("unable to send handshake ")
@@ -62,30 +123,25 @@ func (sc *Server) one() error {
 		return errors.New("client is enforcing encryption")
 	case 3:
 		return errors.New("server failed to get handshake reply")
+	case 4:
+		return errors.New("client is enforcing a pre-shared key")
+	case 5:
+		return ErrUnauthorized
+	case 6:
+		return errors.New("client isn't using encryption")
 	}
 
 	return errors.New("other error - handshake failed")
 }
 
+// msgLength - sends the maximum message size followed by the ClientId assigned to the client
 func (sc *Server) msgLength() error {
 
-	buff := make([]byte, 4)
+	buff := make([]byte, 8)
 	binary.BigEndian.PutUint32(buff, uint32(sc.config.ServerConfig.MaxMsgSize))
+	binary.BigEndian.PutUint32(buff[4:], uint32(sc.ClientId))
 
-	var err error
-
-	if sc.shouldUseEncryption() {
-		buff, err = encrypt(*sc.cipher, buff)
-		if err != nil {
-			return err
-		}
-	}
-
-	toSend := make([]byte, 4)
-	binary.BigEndian.PutUint32(toSend, uint32(len(buff)))
-	toSend = append(toSend, buff...)
-
-	_, err = sc.getConn().Write(toSend)
+	err := sc.handshakeWrite(buff)
 	if err != nil {
 		return errors.New("unable to send max message length ")
 	}
@@ -100,16 +156,88 @@ func (sc *Server) msgLength() error {
 	return nil
 }
 
+// handshakeOptions - the settings the client must agree with, sent by the server after the message length
+type handshakeOptions struct {
+	Codec             string        `json:"codec"`
+	Compressor        string        `json:"compressor"` // empty when the server doesn't compress messages
+	HeartbeatInterval time.Duration `json:"heartbeat_interval"`
+	HeartbeatMisses   int           `json:"heartbeat_misses"`
+}
+
+// options - sends the handshakeOptions of the server, the client replies whether it agrees with them
+// reply 0 = agreed, 1 = different codec, 2 = unreadable options, 3 = agreed and using the Compressor
+func (sc *Server) options() error {
+
+	buff, err := json.Marshal(&handshakeOptions{
+		Codec:             sc.codec.Name(),
+		Compressor:        compressorName(sc.compressor),
+		HeartbeatInterval: sc.config.ServerConfig.HeartbeatInterval,
+		HeartbeatMisses:   sc.config.ServerConfig.HeartbeatMisses,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = sc.handshakeWrite(buff)
+	if err != nil {
+		return errors.New("unable to send handshake options")
+	}
+
+	reply := make([]byte, 1)
+	_, err = sc.getConn().Read(reply)
+	if err != nil {
+		return errors.New("did not received handshake options reply")
+	}
+
+	switch result := reply[0]; result {
+	case 0, 3:
+		sc.setCompressing(result == 3)
+		return nil
+	case 1:
+		return errors.New("client is using a different codec")
+	}
+
+	return errors.New("other error - handshake options failed")
+}
+
 // 1st message received by the client
 func (cc *Client) handshake() error {
 
-	err := cc.one()
+	var shared [32]byte
+	var err error
+	if cc.usesTLS() {
+		shared, err = cc.startTLS()
+		if err != nil {
+			return err
+		}
+	}
+
+	err = cc.one()
 	if err != nil {
 		return err
 	}
 
 	if cc.shouldUseEncryption() {
-		err = cc.startEncryption()
+		shared, err = cc.startEncryption()
+		if err != nil {
+			return err
+		}
+	}
+
+	if cc.shouldUseEncryption() || cc.usesTLS() {
+		err = cc.identify(shared[:])
+		if err != nil {
+			return err
+		}
+	} else if cc.usesIdentity() {
+		return errors.New("identity keys require encryption or tls")
+	}
+
+	if cc.hasPreSharedKey() {
+		if !cc.shouldUseEncryption() && !cc.usesTLS() {
+			return errors.New("pre-shared keys require encryption or tls")
+		}
+		err = cc.authenticate(shared[:])
 		if err != nil {
 			return err
 		}
@@ -120,13 +248,23 @@ func (cc *Client) handshake() error {
 		return err
 	}
 
+	err = cc.options()
+	if err != nil {
+		return err
+	}
+
+	err = cc.resume()
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
 func (cc *Client) one() error {
 
-	recv := make([]byte, 2)
-	_, err := cc.getConn().Read(recv)
+	recv := make([]byte, 3)
+	_, err := io.ReadFull(cc.getConn(), recv)
 	if err != nil {
 		return errors.New("failed to received handshake message")
 	}
@@ -136,51 +274,250 @@ func (cc *Client) one() error {
 		return errors.New("server has sent a different VERSION number")
 	}
 
+	if recv[1] == 2 {
+		return errors.New("server has reached the maximum number of clients")
+	}
+
+	if recv[1] == 1 && !cc.shouldUseEncryption() {
+		cc.handshakeSendReply(6)
+		return errors.New("server is enforcing encryption")
+	}
+
 	if recv[1] != 1 && cc.shouldUseEncryption() {
 		cc.handshakeSendReply(2)
 		return errors.New("server tried to connect without encryption")
 	}
 
+	//a client with a key doesn't trust a server which can't prove it has the key too
+	if recv[2] != 1 && cc.hasPreSharedKey() {
+		cc.handshakeSendReply(4)
+		return errors.New("server tried to connect without a pre-shared key")
+	}
+
+	if recv[2] == 1 && !cc.hasPreSharedKey() {
+		cc.handshakeSendReply(5)
+		return errors.New("server requires a pre-shared key")
+	}
+
 	return cc.handshakeSendReply(0)
 }
 
 func (cc *Client) msgLength() error {
 
-	buff := make([]byte, 4)
+	buff, err := cc.handshakeRead()
+	if err != nil {
+		return errors.New(fmt.Sprintf("failed to received max message length: %s", err))
+	}
+
+	if len(buff) < 8 {
+		cc.handshakeSendReply(1)
+		return errors.New("failed to received max message length 4")
+	}
 
-	_, err := cc.getConn().Read(buff)
+	cc.maxMsgSize = bytesToInt(buff[:4])
+	cc.ClientId = bytesToInt(buff[4:])
+	return cc.handshakeSendReply(0)
+}
+
+// options - checks the handshakeOptions sent by the server agree with the config of the client
+func (cc *Client) options() error {
+
+	buff, err := cc.handshakeRead()
 	if err != nil {
-		return errors.New("failed to received max message length 1")
+		return errors.New(fmt.Sprintf("failed to received handshake options: %s", err))
 	}
 
-	var msgLen uint32
-	err = binary.Read(bytes.NewReader(buff), binary.BigEndian, &msgLen) // message length
+	var options handshakeOptions
+	err = json.Unmarshal(buff, &options)
 	if err != nil {
-		return errors.New("failed to read binary")
+		cc.handshakeSendReply(2)
+		return errors.New(fmt.Sprintf("failed to read handshake options: %s", err))
+	}
+
+	if options.Codec != cc.codec.Name() {
+		cc.handshakeSendReply(1)
+		return errors.New(fmt.Sprintf("server is using a different codec: %s", options.Codec))
 	}
 
-	buff = make([]byte, int(msgLen))
+	//the heartbeat of the previous connection may still be reading them
+	cc.mutex.Lock()
+	cc.heartbeatInterval = options.HeartbeatInterval
+	cc.heartbeatMisses = options.HeartbeatMisses
+	cc.mutex.Unlock()
+
+	//messages are only compressed when both sides use the same Compressor
+	compressing := options.Compressor != "" && options.Compressor == compressorName(cc.compressor)
+	if !compressing && options.Compressor != compressorName(cc.compressor) {
+		cc.logger.Warnf("%s.options the server is using a different compressor: %q, messages won't be compressed", cc, options.Compressor)
+	}
+	cc.setCompressing(compressing)
 
-	_, err = cc.getConn().Read(buff)
+	if compressing {
+		return cc.handshakeSendReply(3)
+	}
+	return cc.handshakeSendReply(0)
+}
+
+// resume - receives the token of the session the client wants to resume along with the seq of
+// the last message it received and its receive window, replying whether the session has been resumed
+// byte 0 = 1 when resumed, bytes 1-4 = the seq of the last message received, bytes 5-8 = the
+// receive window, the rest = the token
+func (sc *Server) resume() error {
+
+	buff, err := sc.handshakeRead()
 	if err != nil {
-		return errors.New("failed to received max message length 2")
+		return errors.New(fmt.Sprintf("failed to received session: %s", err))
 	}
 
-	if cc.shouldUseEncryption() {
-		buff, err = decrypt(*cc.cipher, buff)
+	if len(buff) < 8 {
+		return errors.New("failed to received session 8")
+	}
+
+	received := binary.BigEndian.Uint32(buff[:4])
+	window := binary.BigEndian.Uint32(buff[4:8])
+	token := buff[8:]
+
+	owner := sc.sessionOwner()
+	resumed := sc.findSession(token, owner)
+	if !resumed {
+		token, err = newSessionToken()
 		if err != nil {
-			return errors.New("failed to received max message length 3")
+			return err
 		}
 	}
 
-	var maxMsgSize uint32
-	err = binary.Read(bytes.NewReader(buff), binary.BigEndian, &maxMsgSize) // message length
+	reply := make([]byte, 9, 9+len(token))
+	if resumed {
+		reply[0] = 1
+	}
+	_, ownReceived := sc.session.state()
+	binary.BigEndian.PutUint32(reply[1:], ownReceived)
+	binary.BigEndian.PutUint32(reply[5:], uint32(sc.flow.ownWindow))
+
+	err = sc.handshakeWrite(append(reply, token...))
 	if err != nil {
-		return errors.New("failed to read binary")
+		return errors.New("unable to send session")
 	}
 
-	cc.maxMsgSize = int(maxMsgSize)
-	return cc.handshakeSendReply(0)
+	sc.resumeSession(resumed, token, received)
+	sc.session.setOwner(owner)
+	sc.flow.reset(int(window))
+
+	return nil
+}
+
+// findSession - whether the token is of a session the client can resume, a MultiClient server
+// adopts the session of the disconnected client server
+func (sc *Server) findSession(token []byte, owner string) bool {
+
+	if len(token) == 0 {
+		return false
+	}
+
+	if sc.pool != nil {
+		s := sc.pool.takeSession(token, owner)
+		if s == nil {
+			return false
+		}
+		sc.session = s
+		return true
+	}
+
+	return sc.session.resumableBy(token, owner)
+}
+
+// sessionOwner - identifies the client by the pre-shared key, identity key and process it connected
+// with, so another client presenting the token of its session can't take over its messages
+func (sc *Server) sessionOwner() string {
+
+	owner := fmt.Sprintf("key:%q", sc.keyId)
+	if identity := sc.PeerIdentity(); identity != nil {
+		owner += " identity:" + identity.Fingerprint
+	}
+	if peer := sc.PeerCredentials(); peer != nil {
+		owner += fmt.Sprintf(" peer:%d:%d:%d", peer.UID, peer.GID, peer.PID)
+	}
+
+	return owner
+}
+
+// resume - asks the server to resume the session, the first connection has no session to resume.
+// The receive windows of both sides are exchanged too.
+func (cc *Client) resume() error {
+
+	token, received := cc.session.state()
+
+	buff := make([]byte, 8, 8+len(token))
+	binary.BigEndian.PutUint32(buff, received)
+	binary.BigEndian.PutUint32(buff[4:], uint32(cc.flow.ownWindow))
+
+	err := cc.handshakeWrite(append(buff, token...))
+	if err != nil {
+		return errors.New("unable to send session")
+	}
+
+	reply, err := cc.handshakeRead()
+	if err != nil {
+		return errors.New(fmt.Sprintf("failed to received session: %s", err))
+	}
+
+	if len(reply) < 9 {
+		return errors.New("failed to received session 9")
+	}
+
+	cc.resumeSession(reply[0] == 1, reply[9:], binary.BigEndian.Uint32(reply[1:5]))
+	cc.flow.reset(int(binary.BigEndian.Uint32(reply[5:9])))
+
+	return nil
+}
+
+// handshakeWrite - sends a length prefixed handshake message, encrypted once encryption has started
+func (a *Actor) handshakeWrite(buff []byte) error {
+
+	var err error
+
+	if a.shouldUseEncryption() {
+		buff, err = a.encrypt(buff)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = a.getConn().Write(append(intToBytes(len(buff)), buff...))
+	return err
+}
+
+// handshakeRead - receives a length prefixed handshake message sent with handshakeWrite
+func (a *Actor) handshakeRead() ([]byte, error) {
+
+	buff := make([]byte, 4)
+
+	_, err := io.ReadFull(a.getConn(), buff)
+	if err != nil {
+		return nil, err
+	}
+
+	//the handshake messages are small, a larger length means the peer is speaking another protocol
+	n := bytesToInt(buff)
+	if n < 0 || n > MAX_MSG_SIZE {
+		return nil, errors.New(fmt.Sprintf("handshake message length %d isn't valid", n))
+	}
+
+	//the read is bounded by the context of the handshake
+	buff = make([]byte, n)
+	_, err = io.ReadFull(a.getConn(), buff)
+	if err != nil {
+		return nil, err
+	}
+
+	if a.shouldUseEncryption() {
+		buff, err = a.decrypt(buff)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return buff, nil
 }
 
 func (cc *Client) handshakeSendReply(result byte) error {
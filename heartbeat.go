@@ -0,0 +1,90 @@
+package ipc
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// getHeartbeat - the interval heartbeats are sent at and the number which can be missed before
+// the other side is considered dead, dictated by the server and sent to the client in the handshake
+func (a *Actor) getHeartbeat() (time.Duration, int) {
+
+	var interval time.Duration
+	var misses int
+	if a.config.IsServer {
+		interval = a.config.ServerConfig.HeartbeatInterval
+		misses = a.config.ServerConfig.HeartbeatMisses
+	} else {
+		a.mutex.Lock()
+		interval = a.clientRef.heartbeatInterval
+		misses = a.clientRef.heartbeatMisses
+		a.mutex.Unlock()
+	}
+
+	if misses <= 0 {
+		misses = HEARTBEAT_MISSES
+	}
+
+	return interval, misses
+}
+
+// receivedAt - records that a frame has been received, every frame shows the other side is alive
+func (a *Actor) receivedAt(t time.Time) {
+	atomic.StoreInt64(a.lastReceived, t.UnixNano())
+}
+
+func (a *Actor) sinceReceived() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(a.lastReceived)))
+}
+
+// deliver - passes a message to Read. The connection doesn't read the heartbeats of the other side
+// until the message has been read, so it isn't timed out meanwhile and the frames it has written
+// since are given the whole timeout to be read.
+func (a *Actor) deliver(m *Message) {
+	atomic.AddInt32(a.delivering, 1)
+	a.received <- m
+	atomic.AddInt32(a.delivering, -1)
+	a.receivedAt(time.Now())
+}
+
+func (a *Actor) isDelivering() bool {
+	return atomic.LoadInt32(a.delivering) > 0
+}
+
+// heartbeat - sends a control message every interval until stopped, closing the connection
+// once nothing has been received for the number of heartbeats which can be missed, unless a
+// message is waiting to be read. The connection then ends the same way it does when the
+// other side disconnects.
+func (a *Actor) heartbeat(stop chan struct{}) {
+
+	interval, misses := a.getHeartbeat()
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		if !a.isDelivering() && a.sinceReceived() > interval*time.Duration(misses) {
+			a.logger.Warnf("%s.heartbeat missed %d heartbeats", a, misses)
+			a.dispatchStatus(Timeout)
+			a.getConn().Close()
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		err := a.writeFrame(ctx, &frame{flags: frameHeartbeat})
+		cancel()
+		if err != nil {
+			a.logger.Debugf("%s.heartbeat err: %s", a, err)
+		}
+	}
+}
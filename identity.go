@@ -0,0 +1,317 @@
+package ipc
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrUntrustedIdentity - dispatched by the server when a client fails to prove it has an identity key
+// it trusts, the connection is closed and the server carries on listening
+var ErrUntrustedIdentity = errors.New("client failed to authenticate with a trusted identity key")
+
+// ErrIdentityRejected - dispatched by the server when a client doesn't trust its identity key, the
+// connection is closed and the server carries on listening for a client which does
+var ErrIdentityRejected = errors.New("client rejected the identity of the server")
+
+// PeerIdentity - the long-term identity key the other side proved it has during the handshake
+type PeerIdentity struct {
+	Key         *ecdsa.PublicKey
+	Fingerprint string // the hex encoded sha256 of the public key
+	Name        string // the name of the key in the TrustStore, or its Fingerprint when it is one of the TrustedKeys
+	Trusted     bool   // whether the key is one of the TrustedKeys or in the TrustStore
+}
+
+// GenerateIdentityKey - creates a P-384 identity key pair
+func GenerateIdentityKey() (*ecdsa.PrivateKey, error) {
+	return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+}
+
+// WriteIdentityKey - saves the identity key as a PEM encoded file only readable by its owner
+func WriteIdentityKey(path string, key *ecdsa.PrivateKey) error {
+
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+}
+
+// LoadIdentityKey - reads an identity key saved by WriteIdentityKey
+func LoadIdentityKey(path string) (*ecdsa.PrivateKey, error) {
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "EC PRIVATE KEY" {
+		return nil, errors.New(fmt.Sprintf("%s doesn't contain an identity key", path))
+	}
+
+	return x509.ParseECPrivateKey(block.Bytes)
+}
+
+// WriteTrustedKey - adds the public key of a peer to the TrustStore directory under the name
+func WriteTrustedKey(dir string, name string, key *ecdsa.PublicKey) error {
+
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(dir, name+".pem"), pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600)
+}
+
+// LoadTrustedKey - reads a public key saved by WriteTrustedKey
+func LoadTrustedKey(path string) (*ecdsa.PublicKey, error) {
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, errors.New(fmt.Sprintf("%s doesn't contain a public key", path))
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	ecKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("%s doesn't contain an ecdsa public key", path))
+	}
+
+	return ecKey, nil
+}
+
+// identityConfig - the identity key of this side along with the keys of the peers it trusts
+func (a *Actor) identityConfig() (*ecdsa.PrivateKey, []*ecdsa.PublicKey, string) {
+	if a.config.IsServer {
+		return a.config.ServerConfig.IdentityKey, a.config.ServerConfig.TrustedKeys, a.config.ServerConfig.TrustStore
+	}
+	return a.config.ClientConfig.IdentityKey, a.config.ClientConfig.TrustedKeys, a.config.ClientConfig.TrustStore
+}
+
+// usesIdentity - whether this side has an identity key or only trusts the peers with the keys it knows
+func (a *Actor) usesIdentity() bool {
+	key, trusted, trustStore := a.identityConfig()
+	return key != nil || len(trusted) > 0 || trustStore != ""
+}
+
+// identityMessage - the public identity key followed by its signature of the shared secret of the
+// key exchange, which can't be relayed to another connection. Empty without an identity key.
+// bytes 0-1 = the length of the PKIX encoded key, followed by the key and the ASN.1 signature
+func (a *Actor) identityMessage(side string, shared []byte) ([]byte, error) {
+
+	key, _, _ := a.identityConfig()
+	if key == nil {
+		return nil, nil
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := ecdsa.SignASN1(rand.Reader, key, identityDigest(side, shared))
+	if err != nil {
+		return nil, err
+	}
+
+	buff := make([]byte, 2, 2+len(der)+len(sig))
+	binary.BigEndian.PutUint16(buff, uint16(len(der)))
+	buff = append(buff, der...)
+
+	return append(buff, sig...), nil
+}
+
+// verifyIdentity - checks the identity message of the other side, the identity is nil when it
+// doesn't have an identity key, which is only accepted when this side doesn't trust specific keys
+func (a *Actor) verifyIdentity(side string, shared []byte, buff []byte) (*PeerIdentity, error) {
+
+	_, trusted, trustStore := a.identityConfig()
+	required := len(trusted) > 0 || trustStore != ""
+
+	if len(buff) == 0 {
+		if required {
+			return nil, errors.New(fmt.Sprintf("%s didn't present an identity key", side))
+		}
+		return nil, nil
+	}
+
+	if len(buff) < 2 || len(buff) < 2+int(binary.BigEndian.Uint16(buff)) {
+		return nil, errors.New(fmt.Sprintf("%s sent a malformed identity", side))
+	}
+	der, sig := buff[2:2+binary.BigEndian.Uint16(buff)], buff[2+binary.BigEndian.Uint16(buff):]
+
+	parsed, err := x509.ParsePKIXPublicKey(der)
+	key, ok := parsed.(*ecdsa.PublicKey)
+	if err != nil || !ok {
+		return nil, errors.New(fmt.Sprintf("%s sent an invalid identity key", side))
+	}
+
+	if !ecdsa.VerifyASN1(key, identityDigest(side, shared), sig) {
+		return nil, errors.New(fmt.Sprintf("%s failed to prove it has its identity key", side))
+	}
+
+	fingerprint := sha256.Sum256(der)
+	identity := &PeerIdentity{Key: key, Fingerprint: hex.EncodeToString(fingerprint[:])}
+
+	identity.Name, identity.Trusted = trusts(key, trusted, trustStore)
+	if identity.Name == "" && identity.Trusted {
+		identity.Name = identity.Fingerprint
+	}
+
+	if required && !identity.Trusted {
+		return nil, errors.New(fmt.Sprintf("%s presented an untrusted identity key %s", side, identity.Fingerprint))
+	}
+
+	return identity, nil
+}
+
+// trusts - whether the key is one of the pinned keys or in the TrustStore directory, returning the name
+// of its file. The TrustStore is read for each connection so keys can be added without restarting.
+func trusts(key *ecdsa.PublicKey, trusted []*ecdsa.PublicKey, trustStore string) (string, bool) {
+
+	for _, k := range trusted {
+		if k != nil && k.Equal(key) {
+			return "", true
+		}
+	}
+
+	if trustStore == "" {
+		return "", false
+	}
+
+	paths, _ := filepath.Glob(filepath.Join(trustStore, "*.pem"))
+	for _, path := range paths {
+		k, err := LoadTrustedKey(path)
+		if err == nil && k.Equal(key) {
+			return strings.TrimSuffix(filepath.Base(path), ".pem"), true
+		}
+	}
+
+	return "", false
+}
+
+func identityDigest(side string, shared []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte("ipc identity " + side))
+	h.Write(shared)
+	return h.Sum(nil)
+}
+
+// identify - sends the identity of the server and checks the identity the client replies with
+// the client replies with byte 0 = 0 followed by its identity message, or 1 when it rejected the
+// server, the server replies with byte 0 = 0 when it accepted the client or 1 when it rejected it
+func (sc *Server) identify(shared []byte) error {
+
+	buff, err := sc.identityMessage("server", shared)
+	if err != nil {
+		return err
+	}
+
+	err = sc.handshakeWrite(buff)
+	if err != nil {
+		return errors.New("unable to send identity")
+	}
+
+	reply, err := sc.handshakeRead()
+	if err != nil {
+		return errors.New(fmt.Sprintf("failed to received identity: %s", err))
+	}
+
+	if len(reply) == 0 || reply[0] != 0 {
+		return ErrIdentityRejected
+	}
+
+	identity, err := sc.verifyIdentity("client", shared, reply[1:])
+	if err != nil {
+		sc.logger.Errorf("%s.identify err: %s", sc, err)
+		sc.handshakeWrite([]byte{1})
+		return ErrUntrustedIdentity
+	}
+
+	err = sc.handshakeWrite([]byte{0})
+	if err != nil {
+		return errors.New("unable to send identity reply")
+	}
+
+	sc.setPeerIdentity(identity)
+
+	return nil
+}
+
+// identify - checks the identity of the server before proving its own
+func (cc *Client) identify(shared []byte) error {
+
+	buff, err := cc.handshakeRead()
+	if err != nil {
+		return errors.New(fmt.Sprintf("failed to received identity: %s", err))
+	}
+
+	identity, err := cc.verifyIdentity("server", shared, buff)
+	if err != nil {
+		cc.handshakeWrite([]byte{1})
+		return err
+	}
+
+	buff, err = cc.identityMessage("client", shared)
+	if err != nil {
+		return err
+	}
+
+	err = cc.handshakeWrite(append([]byte{0}, buff...))
+	if err != nil {
+		return errors.New("unable to send identity")
+	}
+
+	reply, err := cc.handshakeRead()
+	if err != nil {
+		return errors.New(fmt.Sprintf("failed to received identity reply: %s", err))
+	}
+
+	if len(reply) == 0 || reply[0] != 0 {
+		return errors.New("server rejected the identity of the client")
+	}
+
+	cc.setPeerIdentity(identity)
+
+	return nil
+}
+
+// PeerIdentity - the identity key the other side proved it has during the handshake, nil when it
+// doesn't have one or encryption is disabled
+func (a *Actor) PeerIdentity() *PeerIdentity {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.identity
+}
+
+func (a *Actor) setPeerIdentity(identity *PeerIdentity) {
+	a.mutex.Lock()
+	a.identity = identity
+	a.mutex.Unlock()
+}
@@ -0,0 +1,153 @@
+//go:build linux && !network
+
+package ipc
+
+import (
+	"errors"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPeerCredentials(t *testing.T) {
+
+	sc, err := StartServer(serverConfig("test_peer_credentials"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	Sleep()
+
+	cc, err := StartClient(clientConfig("test_peer_credentials"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	peer := sc.PeerCredentials()
+	if peer == nil || peer.UID != uint32(os.Getuid()) || peer.GID != uint32(os.Getgid()) || peer.PID != os.Getpid() {
+		t.Fatalf("unexpected peer credentials: %+v", peer)
+	}
+
+	groups, _ := os.Getgroups()
+	for _, gid := range groups {
+		if !slices.Contains(peer.Groups, uint32(gid)) {
+			t.Errorf("expected the supplementary group %d in %v", gid, peer.Groups)
+		}
+	}
+}
+
+func TestPeerNotAllowed(t *testing.T) {
+
+	scon := serverConfig("test_peer_not_allowed")
+	scon.AllowedUIDs = []uint32{uint32(os.Getuid()) + 1}
+	sc, err := StartServer(scon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	Sleep()
+
+	ccon := clientConfig("test_peer_not_allowed")
+	ccon.Timeout = time.Second
+	_, err = StartClient(ccon)
+	if err == nil {
+		t.Error("expected the client to be rejected before the handshake")
+	}
+
+	for {
+		e := <-sc.Events()
+		if e.Err != nil {
+			if !strings.HasPrefix(e.Err.Error(), "peer rejected, uid") {
+				t.Errorf("expected the server to reject the peer, got: %s", e.Err)
+			}
+			break
+		}
+	}
+
+	//the server carries on listening for an allowed peer
+	if sc.getStatus() != Listening {
+		t.Errorf("expected the server to be listening, got: %s", sc.Status())
+	}
+}
+
+func TestAuthorizePeer(t *testing.T) {
+
+	scon := serverConfig("test_authorize_peer")
+	scon.MultiClient = true
+	scon.AllowedGIDs = []uint32{uint32(os.Getgid())}
+	scon.AuthorizePeer = func(peer *PeerCredentials) error {
+		if peer.PID != os.Getpid() {
+			return errors.New("unexpected process")
+		}
+		return nil
+	}
+	sc, err := StartServer(scon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	Sleep()
+
+	cc, err := StartClient(clientConfig("test_authorize_peer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	if !sc.Connections.waitForServers(time.Second) {
+		t.Fatal("expected the client to join the pool")
+	}
+	if peer := sc.Connections.getServers()[0].PeerCredentials(); peer == nil || peer.PID != os.Getpid() {
+		t.Errorf("unexpected peer credentials: %+v", peer)
+	}
+}
+
+func TestAuthorizePeerConcurrently(t *testing.T) {
+
+	scon := serverConfig("test_authorize_peer_concurrently")
+	scon.MultiClient = true
+
+	//the first peer is held up by the callback, which mustn't stop the next from joining
+	release := make(chan struct{})
+	var calls atomic.Int32
+	scon.AuthorizePeer = func(peer *PeerCredentials) error {
+		if calls.Add(1) == 1 {
+			<-release
+		}
+		return nil
+	}
+	sc, err := StartServer(scon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+	defer close(release)
+
+	Sleep()
+
+	go func() {
+		ccon := clientConfig("test_authorize_peer_concurrently")
+		ccon.Timeout = 2 * time.Second
+		if cc, err := StartClient(ccon); err == nil {
+			cc.Close()
+		}
+	}()
+	for calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ccon := clientConfig("test_authorize_peer_concurrently")
+	ccon.Timeout = time.Second
+	cc, err := StartClient(ccon)
+	if err != nil {
+		t.Fatalf("expected the second client to connect while the first is being authorized, got: %v", err)
+	}
+	defer cc.Close()
+}
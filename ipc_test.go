@@ -1,9 +1,28 @@
 package ipc
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -22,6 +41,16 @@ func clientConfig(name string) *ClientConfig {
 	return &ClientConfig{Name: name, Encryption: ENCRYPT_BY_DEFAULT}
 }
 
+// waitForStatus - blocks until the Actor dispatches an Event with the status
+func waitForStatus(a *Actor, status Status) {
+	for {
+		e := <-a.Events()
+		if e.Err == nil && e.Status == status {
+			return
+		}
+	}
+}
+
 func TestStartUp_Name(t *testing.T) {
 
 	_, err := StartServer(serverConfig(""))
@@ -197,23 +226,7 @@ func TestWrite(t *testing.T) {
 	}
 	defer cc.Close()
 
-	connected := make(chan bool, 1)
-
-	go func() {
-
-		for {
-
-			m, err := cc.Read()
-			if err != nil {
-				//t.Error(fmt.Sprintf("Got read error: %s", err))
-			} else if m.Status == "Connected" {
-				connected <- true
-				return
-			}
-		}
-	}()
-
-	<-connected
+	waitForStatus(&cc.Actor, Connected)
 
 	buf := make([]byte, 1)
 
@@ -415,14 +428,8 @@ func TestGetConnected(t *testing.T) {
 	}
 	defer cc.Close()
 
-	for {
-		cc.Read()
-		m, _ := sc.Read()
-
-		if m.Status == "Connected" {
-			break
-		}
-	}
+	waitForStatus(&cc.Actor, Connected)
+	waitForStatus(&sc.Actor, Connected)
 }
 
 func TestServerWrongMessageType(t *testing.T) {
@@ -447,39 +454,22 @@ func TestServerWrongMessageType(t *testing.T) {
 
 	go func() {
 
-		ready := false
-
-		for {
-			m, _ := sc.Read()
-			if m.Status == "Connected" {
-				connected <- true
-				ready = true
-				continue
-			}
+		waitForStatus(&sc.Actor, Connected)
+		connected <- true
 
-			if ready == true {
-				if m.MsgType != 5 {
-					// received wrong message type
+		m, _ := sc.Read()
+		if m.MsgType != 5 {
+			// received wrong message type
 
-				} else {
-					t.Error("should have got wrong message type")
-				}
-				complete <- true
-				break
-			}
+		} else {
+			t.Error("should have got wrong message type")
 		}
-
+		complete <- true
 	}()
 
 	go func() {
-		for {
-			m, _ := cc.Read()
-
-			if m.Status == "Connected" {
-				connected2 <- true
-				return
-			}
-		}
+		waitForStatus(&cc.Actor, Connected)
+		connected2 <- true
 	}()
 
 	<-connected
@@ -511,48 +501,25 @@ func TestClientWrongMessageType(t *testing.T) {
 	complete := make(chan bool, 1)
 
 	go func() {
-		for {
-			m, _ := sc.Read()
-			if m.Status == "Connected" {
-				connected2 <- true
-				return
-			}
-
-		}
+		waitForStatus(&sc.Actor, Connected)
+		connected2 <- true
 	}()
 
 	go func() {
 
-		ready := false
-
-		for {
-
-			m, err45 := cc.Read()
-
-			if m.Status == "Connected" {
-				connected <- true
-				ready = true
-				continue
-
-			}
-
-			if ready == true {
-
-				if err45 == nil {
-					if m.MsgType != 5 {
-						// received wrong message type
-					} else {
-						t.Error("should have got wrong message type")
-					}
-					complete <- true
-					break
+		waitForStatus(&cc.Actor, Connected)
+		connected <- true
 
-				} else {
-					t.Error(err45)
-					break
-				}
+		m, err45 := cc.Read()
+		if err45 == nil {
+			if m.MsgType != 5 {
+				// received wrong message type
+			} else {
+				t.Error("should have got wrong message type")
 			}
-
+			complete <- true
+		} else {
+			t.Error(err45)
 		}
 	}()
 
@@ -583,42 +550,26 @@ func TestServerCorrectMessageType(t *testing.T) {
 	complete := make(chan bool, 1)
 
 	go func() {
-		for {
-			m, err := sc.Read()
-			if err == nil && m.Status == "Connected" {
-				connected2 <- true
-				return
-			}
-		}
+		waitForStatus(&sc.Actor, Connected)
+		connected2 <- true
 	}()
 
 	go func() {
 
-		ready := false
+		waitForStatus(&cc.Actor, Connected)
+		connected <- true
 
-		for {
-			m, err23 := cc.Read()
-			if err23 == nil && m.Status == "Connected" {
-				ready = true
-				connected <- true
-				continue
-			}
-			if ready == true {
-				if err23 == nil {
-					if m.MsgType == 5 {
-						// received correct message type
-					} else {
-						t.Error("should have got correct message type")
-					}
-
-					complete <- true
-					return
-				} else {
-					t.Error(err23)
-					break
-				}
+		m, err23 := cc.Read()
+		if err23 == nil {
+			if m.MsgType == 5 {
+				// received correct message type
+			} else {
+				t.Error("should have got correct message type")
 			}
 
+			complete <- true
+		} else {
+			t.Error(err23)
 		}
 	}()
 
@@ -651,47 +602,26 @@ func TestClientCorrectMessageType(t *testing.T) {
 	complete := make(chan bool, 1)
 
 	go func() {
-
-		for {
-			m, _ := cc.Read()
-
-			if m.Status == "Connected" {
-				connected2 <- true
-				return
-			}
-		}
-
+		waitForStatus(&cc.Actor, Connected)
+		connected2 <- true
 	}()
 
 	go func() {
 
-		ready := false
-
-		for {
-
-			m, err34 := sc.Read()
+		waitForStatus(&sc.Actor, Connected)
+		connected <- true
 
-			if m.Status == "Connected" {
-				ready = true
-				connected <- true
-				continue
+		m, err34 := sc.Read()
+		if err34 == nil {
+			if m.MsgType == 5 {
+				// received correct message type
+			} else {
+				t.Error("should have got correct message type")
 			}
 
-			if ready == true {
-				if err34 == nil {
-					if m.MsgType == 5 {
-						// received correct message type
-					} else {
-						t.Error("should have got correct message type")
-					}
-
-					complete <- true
-					return
-				} else {
-					t.Error(err34)
-					break
-				}
-			}
+			complete <- true
+		} else {
+			t.Error(err34)
 		}
 	}()
 
@@ -722,57 +652,30 @@ func TestServerSendMessage(t *testing.T) {
 	complete := make(chan bool, 1)
 
 	go func() {
-
-		for {
-
-			m, err := sc.Read()
-			if err != nil {
-				t.Error(fmt.Sprintf("Got read error: %s", err))
-			} else if m.Status == "Connected" {
-				connected <- true
-				return
-			}
-		}
+		waitForStatus(&sc.Actor, Connected)
+		connected <- true
 	}()
 
 	go func() {
 
-		ready := false
-
-		for {
-
-			m, err56 := cc.Read()
-
-			if m.Status == "Connected" {
-				ready = true
-				connected2 <- true
-				continue
-			}
-
-			if ready == true {
-				if err56 == nil {
-					if m.MsgType == 5 {
-						if string(m.Data) == "Here is a test message sent from the server to the client... -/and some more test data to pad it out a bit" {
-							// correct msg has been received
-						} else {
-							t.Error("Message recreceivedieved is wrong")
-						}
-					} else {
-						t.Error("should have got correct message type")
-					}
-
-					complete <- true
-					break
+		waitForStatus(&cc.Actor, Connected)
+		connected2 <- true
 
+		m, err56 := cc.Read()
+		if err56 == nil {
+			if m.MsgType == 5 {
+				if string(m.Data) == "Here is a test message sent from the server to the client... -/and some more test data to pad it out a bit" {
+					// correct msg has been received
 				} else {
-					t.Error(err56)
-					complete <- true
-					break
+					t.Error("Message recreceivedieved is wrong")
 				}
-
+			} else {
+				t.Error("should have got correct message type")
 			}
+		} else {
+			t.Error(err56)
 		}
-
+		complete <- true
 	}()
 
 	<-connected2
@@ -803,56 +706,32 @@ func TestClientSendMessage(t *testing.T) {
 	complete := make(chan bool, 1)
 
 	go func() {
-
-		for {
-
-			m, _ := cc.Read()
-			if m.Status == "Connected" {
-				connected <- true
-				return
-			}
-
-		}
+		waitForStatus(&cc.Actor, Connected)
+		connected <- true
 	}()
 
 	go func() {
 
-		ready := false
-
-		for {
-
-			m, _ := sc.Read()
-
-			if m.Status == "Connected" {
-				ready = true
-				connected2 <- true
-				continue
-			}
-
-			if ready == true {
-				if err == nil {
-					if m.MsgType == 5 {
-
-						if string(m.Data) == "Here is a test message sent from the client to the server... -/and some more test data to pad it out a bit" {
-							// correct msg has been received
-						} else {
-							t.Error("Message recreceivedieved is wrong")
-						}
+		waitForStatus(&sc.Actor, Connected)
+		connected2 <- true
 
-					} else {
-						t.Error("should have got correct message type")
-					}
-					complete <- true
-					break
+		m, err := sc.Read()
+		if err == nil {
+			if m.MsgType == 5 {
 
+				if string(m.Data) == "Here is a test message sent from the client to the server... -/and some more test data to pad it out a bit" {
+					// correct msg has been received
 				} else {
-					t.Error(err)
-					complete <- true
-					break
+					t.Error("Message recreceivedieved is wrong")
 				}
-			}
 
+			} else {
+				t.Error("should have got correct message type")
+			}
+		} else {
+			t.Error(err)
 		}
+		complete <- true
 	}()
 
 	<-connected
@@ -884,9 +763,9 @@ func TestClientClose(t *testing.T) {
 
 		for {
 
-			m, _ := sc.Read()
+			m := <-sc.Events()
 
-			if m.Status == "Disconnected" {
+			if m.Status == Disconnected {
 				holdIt <- false
 				break
 			}
@@ -897,14 +776,14 @@ func TestClientClose(t *testing.T) {
 
 	for {
 
-		mm, err := cc.Read()
+		e := <-cc.Events()
 
-		if err == nil {
-			if mm.Status == "Connected" {
+		if e.Err == nil {
+			if e.Status == Connected {
 				cc.Close()
 			}
 
-			if mm.Status == "Closed" {
+			if e.Status == Closed {
 				break
 			}
 		}
@@ -937,8 +816,8 @@ func TestClientReconnect(t *testing.T) {
 
 	go func() {
 		for {
-			m, _ := sc.Read()
-			if m.Status == "Connected" {
+			m := <-sc.Events()
+			if m.Status == Connected {
 				connected <- true
 				return
 			}
@@ -950,18 +829,16 @@ func TestClientReconnect(t *testing.T) {
 		reconnectCheck := false
 
 		for {
-			m, _ := cc.Read()
-			if m == TimeoutMessage {
-				continue
-			} else if m != nil {
-				if m.Status == "Connected" {
+			m := <-cc.Events()
+			if m.Err == nil {
+				if m.Status == Connected {
 					if !reconnectCheck {
 						clientConnected <- true
 					} else {
 						clientConfirm <- true
 						return
 					}
-				} else if m.Status == "Reconnecting" {
+				} else if m.Status == ReConnecting {
 					reconnectCheck = true
 				}
 			}
@@ -984,8 +861,8 @@ func TestClientReconnect(t *testing.T) {
 
 	for {
 
-		m, _ := sc2.Read()
-		if m.Status == "Connected" {
+		m := <-sc2.Events()
+		if m.Status == Connected {
 			<-clientConfirm
 			break
 		}
@@ -1017,8 +894,8 @@ func TestClientReconnectTimeout(t *testing.T) {
 
 		for {
 
-			m, _ := sc.Read()
-			if m.Status == "Connected" {
+			m := <-sc.Events()
+			if m.Status == Connected {
 				sc.Close()
 				break
 			}
@@ -1031,18 +908,18 @@ func TestClientReconnectTimeout(t *testing.T) {
 
 	for {
 
-		mm, err5 := cc.Read()
+		mm := <-cc.Events()
 
-		if err5 == nil {
-			if mm.Status == "Connected" {
+		if mm.Err == nil {
+			if mm.Status == Connected {
 				connect = true
-			} else if mm.Status == "Reconnecting" {
+			} else if mm.Status == ReConnecting {
 				reconnect = true
-			} else if mm.Status == "Timeout" && reconnect == true && connect == true {
-				return
+			} else if mm.Status == Timeout && (reconnect == false || connect == false) {
+				t.Fatal("should have connected and reconnected before timing out")
 			}
-		} else {
-			if err5.Error() != "timed out trying to re-connect" {
+		} else if mm.Status == Timeout {
+			if mm.Err.Error() != "timed out trying to re-connect" {
 				t.Fatal("should have got the timed out error")
 			}
 			break
@@ -1072,8 +949,8 @@ func TestServerReconnect(t *testing.T) {
 	go func() {
 
 		for {
-			m, _ := cc.Read()
-			if m != nil && m.Status == "Connected" {
+			m := <-cc.Events()
+			if m.Err == nil && m.Status == Connected {
 				<-clientConnected
 				connected <- true
 			}
@@ -1085,15 +962,13 @@ func TestServerReconnect(t *testing.T) {
 		reconnectCheck := 0
 		connectCnt := 0
 		for {
-			m, err := sc.Read()
+			m := <-sc.Events()
 
-			if err != nil {
-				//sc.logger.Debugf("TestServerReconnect sever read loop err: %s", err)
-				//t.Error(err)
-				return
+			if m.Err != nil {
+				continue
 			}
 
-			if m.Status == "Connected" {
+			if m.Status == Connected {
 				if reconnectCheck == 1 && connectCnt > 0 {
 					clientConfirm <- true
 				} else {
@@ -1103,7 +978,7 @@ func TestServerReconnect(t *testing.T) {
 			}
 
 			//dispatched on EOF
-			if m.Status == "Disconnected" {
+			if m.Status == Disconnected {
 				reconnectCheck = 1
 			}
 
@@ -1156,8 +1031,8 @@ func TestServerReconnect2(t *testing.T) {
 			case <-hasReconnected:
 				return
 			default:
-				m, err := cc.Read()
-				if m.Status == "Connected" {
+				m := <-cc.Events()
+				if m.Status == Connected {
 
 					<-hasConnected
 
@@ -1171,8 +1046,8 @@ func TestServerReconnect2(t *testing.T) {
 					}
 
 					for {
-						n, _ := c2.Read()
-						if n.Status == "Connected" {
+						n := <-c2.Events()
+						if n.Status == Connected {
 							c2.Close()
 							break
 						}
@@ -1191,18 +1066,18 @@ func TestServerReconnect2(t *testing.T) {
 		case <-hasReconnected:
 			return
 		default:
-			m, _ := sc.Read()
-			if m.Status == "Connected" && connect == false {
+			m := <-sc.Events()
+			if m.Status == Connected && connect == false {
 				hasConnected <- true
 				connect = true
 			}
 
-			if m.Status == "Disconnected" {
+			if m.Status == Disconnected {
 				hasDisconnected <- true
 				disconnect = true
 			}
 
-			if m.Status == "Connected" && connect == true && disconnect == true {
+			if m.Status == Connected && connect == true && disconnect == true {
 				hasReconnected <- true
 			}
 		}
@@ -1235,8 +1110,8 @@ func TestServerReconnectMulti(t *testing.T) {
 	go func() {
 
 		for {
-			m, _ := cc.Read()
-			if m.Status == "Connected" {
+			m := <-cc.Events()
+			if m.Status == Connected {
 				<-clientConnected
 				connected <- true
 				break
@@ -1250,25 +1125,24 @@ func TestServerReconnectMulti(t *testing.T) {
 		reconnectCheck := 0
 
 		for {
-			//We used ReadTimed in order to scan client buffer on the next loop
-			sc.Connections.ReadTimed(2*time.Second, func(_ *Server, m *Message, err error) {
+			//the events of each client connection are also dispatched on the server
+			m := <-sc.Events()
 
-				if err != nil {
-					return
-				}
+			if m.Err != nil {
+				continue
+			}
 
-				if m.Status == "Connected" {
-					clientConnected <- true
-				}
+			if m.Status == Connected {
+				clientConnected <- true
+			}
 
-				if m.Status == "Disconnected" {
-					reconnectCheck = 1
-				}
+			if m.Status == Disconnected {
+				reconnectCheck = 1
+			}
 
-				if m.Status == "Connected" && reconnectCheck == 1 {
-					clientConfirm <- true
-				}
-			})
+			if m.Status == Connected && reconnectCheck == 1 {
+				clientConfirm <- true
+			}
 		}
 	}()
 
@@ -1285,8 +1159,8 @@ func TestServerReconnectMulti(t *testing.T) {
 	defer c2.Close()
 
 	for {
-		m, _ := c2.Read()
-		if m.Status == "Connected" {
+		m := <-c2.Events()
+		if m.Status == Connected {
 			break
 		}
 	}
@@ -1321,8 +1195,8 @@ func TestServerReconnect2Multi(t *testing.T) {
 			case <-hasReconnected:
 				return
 			default:
-				m, err := cc.Read()
-				if m.Status == "Connected" {
+				m := <-cc.Events()
+				if m.Status == Connected {
 
 					<-hasConnected
 
@@ -1338,8 +1212,8 @@ func TestServerReconnect2Multi(t *testing.T) {
 					}
 
 					for {
-						n, _ := c2.Read()
-						if n.Status == "Connected" {
+						n := <-c2.Events()
+						if n.Status == Connected {
 							c2.Close()
 							break
 						}
@@ -1358,96 +1232,518 @@ func TestServerReconnect2Multi(t *testing.T) {
 		case <-hasReconnected:
 			return
 		default:
-			sc.Connections.ReadTimed(2*time.Second, func(_ *Server, m *Message, err error) {
-				if m.Status == "Connected" && connect == false {
-					hasConnected <- true
-					connect = true
-				}
+			m := <-sc.Events()
+			if m.Err != nil {
+				continue
+			}
 
-				if m.Status == "Disconnected" {
-					hasDisconnected <- true
-					disconnect = true
-				}
+			if m.Status == Connected && connect == false {
+				hasConnected <- true
+				connect = true
+			}
 
-				if m.Status == "Connected" && connect == true && disconnect == true {
-					hasReconnected <- true
-				}
-			})
+			if m.Status == Disconnected {
+				hasDisconnected <- true
+				disconnect = true
+			}
+
+			if m.Status == Connected && connect == true && disconnect == true {
+				hasReconnected <- true
+			}
 		}
 	}
 }
 
-func TestClientReadClose(t *testing.T) {
+func TestServerAcceptMulti(t *testing.T) {
 
-	sc, err := StartServer(serverConfig("test_clientReadClose"))
+	scon := serverConfig("test_accept_multi")
+	scon.MultiClient = true
+	sc, err := StartServer(scon)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
+	defer sc.Close()
 
 	Sleep()
 
-	config := &ClientConfig{
-		Timeout:    3 * time.Second,
-		RetryTimer: 1 * time.Second,
-		Name:       "test_clientReadClose",
-		Encryption: ENCRYPT_BY_DEFAULT,
+	clients := make([]*Client, 3)
+	for i := range clients {
+		cc, err2 := StartClient(clientConfig("test_accept_multi"))
+		if err2 != nil {
+			t.Fatal(err2)
+		}
+		defer cc.Close()
+		if cc.ClientId != i+1 {
+			t.Errorf("expected the ClientId to be %d, got %d", i+1, cc.ClientId)
+		}
+		clients[i] = cc
 	}
 
-	cc, err2 := StartClient(config)
-	if err2 != nil {
-		t.Error(err2)
+	//the client finishes the handshake just before the server adds it to the pool
+	for i := 0; len(sc.Connections.getServers()) != 3; i++ {
+		if i == 100 {
+			t.Fatalf("expected 3 client servers, got %d", len(sc.Connections.getServers()))
+		}
+		time.Sleep(10 * time.Millisecond)
 	}
-	defer cc.Close()
-
-	connected := make(chan bool, 1)
-	clientTimout := make(chan bool, 1)
-	clientConnected := make(chan bool, 1)
-	clientError := make(chan bool, 1)
 
-	go func() {
+	if err = sc.Write(5, []byte("no client")); err == nil {
+		t.Error("writing to a multi-client server should have returned an error")
+	}
+	if err = sc.WriteMessage(&Message{MsgType: 5, Data: []byte("no client")}); err == nil {
+		t.Error("writing a message to a multi-client server should have returned an error")
+	}
+	if err = sc.WriteValue(5, "no client"); err == nil {
+		t.Error("writing a value to a multi-client server should have returned an error")
+	}
+	if _, err = sc.NetConn().Write([]byte("no client")); err == nil {
+		t.Error("writing to the net.Conn of a multi-client server should have returned an error")
+	}
 
-		for {
+	for _, cc := range clients {
+		cc.Write(5, []byte(fmt.Sprintf("hello from %d", cc.ClientId)))
+	}
 
-			m, _ := sc.Read()
-			if m.Status == "Connected" {
-				connected <- true
-				break
+	received := make(chan bool, 3)
+	for len(received) < 3 {
+		sc.Connections.ReadTimed(2*time.Second, func(s *Server, m *Message, err error) {
+			if err != nil || m == TimeoutMessage || m.MsgType != 5 {
+				return
 			}
+			if string(m.Data) != fmt.Sprintf("hello from %d", s.ClientId) {
+				t.Errorf("client server %d received %q", s.ClientId, m.Data)
+			}
+			received <- true
+		})
+	}
+}
 
-		}
-	}()
-
-	go func() {
+func TestClientCall(t *testing.T) {
 
-		reconnect := false
+	sc, err := StartServer(serverConfig("test_call"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
 
-		for {
+	sc.HandleCall(7, func(request *Message) ([]byte, error) {
+		if string(request.Data) == "fail" {
+			return nil, errors.New("the request failed")
+		}
+		if string(request.Data) == "slow" {
+			time.Sleep(500 * time.Millisecond)
+		}
+		return append([]byte("response to "), request.Data...), nil
+	})
 
-			m, err3 := cc.Read()
+	Sleep()
 
-			if err3 != nil {
-				log.Printf("err: %s", err3)
-				if err3.Error() == "the received channel has been closed" {
-					clientError <- true // after the connection times out the received channel is closed, so we're now testing that the close error is returned.
-					// This is the only error the received function returns.
-					break
-				}
-			}
+	cc, err := StartClient(clientConfig("test_call"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
 
-			if err3 == nil {
-				if m.Status == "Connected" {
-					clientConnected <- true
-				} else if m.Status == "Reconnecting" {
-					reconnect = true
-				} else if m.Status == "Timeout" && reconnect == true {
-					clientTimout <- true
-				}
-			}
+	//the slow call shouldn't hold up the other calls awaiting a response
+	slowDone := make(chan bool, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err := cc.Call(ctx, 7, []byte("slow"))
+		if err != context.DeadlineExceeded {
+			t.Errorf("expected the slow call to exceed its deadline, got: %v", err)
 		}
+		slowDone <- true
 	}()
 
-	<-connected
-	<-clientConnected
+	results := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		go func(i int) {
+			request := fmt.Sprintf("request %d", i)
+			m, err := cc.Call(context.Background(), 7, []byte(request))
+			if err == nil && string(m.Data) != "response to "+request {
+				err = fmt.Errorf("got %q in response to %q", m.Data, request)
+			}
+			results <- err
+		}(i)
+	}
+
+	for i := 0; i < 10; i++ {
+		if err := <-results; err != nil {
+			t.Error(err)
+		}
+	}
+
+	_, err = cc.Call(context.Background(), 7, []byte("fail"))
+	if err == nil || err.Error() != "the request failed" {
+		t.Errorf("expected the handler error to be returned, got: %v", err)
+	}
+
+	<-slowDone
+}
+
+func TestClientCallReply(t *testing.T) {
+
+	sc, err := StartServer(serverConfig("test_call_reply"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	Sleep()
+
+	cc, err := StartClient(clientConfig("test_call_reply"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	go func() {
+		for {
+			m, err := sc.Read()
+			if err != nil {
+				return
+			}
+			if m.MsgType == 8 {
+				if m.RequestId == 0 {
+					t.Error("expected the request to have a RequestId")
+				}
+				sc.Reply(m, []byte("replied"))
+				return
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	m, err := cc.Call(ctx, 8, []byte("unhandled"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(m.Data) != "replied" {
+		t.Errorf("Got %q, Wanted %q", m.Data, "replied")
+	}
+}
+
+func TestStartClientContext(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		cancel()
+	}()
+
+	startTime := time.Now()
+	cc, err := StartClientContext(ctx, clientConfig("test_start_client_context"))
+	defer cc.Close()
+
+	if err != context.Canceled {
+		t.Errorf("expected the context to cancel dialing, got: %v", err)
+	}
+
+	if time.Since(startTime) > time.Second {
+		t.Errorf("dialing should have stopped when the context was cancelled, took %s", time.Since(startTime))
+	}
+
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	cancel2()
+	_, err = StartServerContext(ctx2, serverConfig("test_start_client_context"))
+	if err != context.Canceled {
+		t.Errorf("expected the cancelled context to prevent the server from starting, got: %v", err)
+	}
+}
+
+func TestReadWriteContext(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sc, err := StartServerContext(ctx, serverConfig("test_read_context"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Sleep()
+
+	cc, err := StartClient(clientConfig("test_read_context"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	waitForStatus(&sc.Actor, Connected)
+
+	goroutines := runtime.NumGoroutine()
+	for i := 0; i < 10; i++ {
+		m, err := sc.ReadTimed(10 * time.Millisecond)
+		if m != TimeoutMessage {
+			t.Errorf("expected a TimeoutMessage, got %v %s", m, err)
+		}
+	}
+	if runtime.NumGoroutine() > goroutines {
+		t.Errorf("ReadTimed shouldn't leave goroutines behind, had %d now %d", goroutines, runtime.NumGoroutine())
+	}
+
+	readCtx, readCancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer readCancel()
+	for {
+		_, err = sc.ReadContext(readCtx)
+		if err != nil {
+			break
+		}
+	}
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected the read to exceed its deadline, got: %v", err)
+	}
+
+	err = cc.WriteContext(context.Background(), 5, []byte("with context"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	for {
+		m, err := sc.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.MsgType == 5 {
+			break
+		}
+	}
+
+	writeCtx, writeCancel := context.WithCancel(context.Background())
+	writeCancel()
+	cc.setStatus(Connecting)
+	err = cc.WriteContext(writeCtx, 5, []byte("cancelled"))
+	if err != context.Canceled {
+		t.Errorf("expected the write to be cancelled while connecting, got: %v", err)
+	}
+	cc.setStatus(Connected)
+
+	//cancelling the context closes the server
+	cancel()
+	for i := 0; sc.getStatus() != Closing && sc.getStatus() != Closed; i++ {
+		if i == 100 {
+			t.Fatalf("expected the server to close, got %s", sc.Status())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRouter(t *testing.T) {
+
+	sc, err := StartServer(serverConfig("test_router"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	connected := make(chan bool, 1)
+	fallback := make(chan int, 1)
+	slow := make(chan bool)
+
+	router := NewRouter()
+	router.SetConcurrency(2)
+	router.Handle(5, func(a *Actor, m *Message) {
+		a.Write(6, append([]byte("echo "), m.Data...))
+	})
+	router.Handle(7, func(a *Actor, m *Message) {
+		<-slow
+	})
+	router.HandleFallback(func(a *Actor, m *Message) {
+		fallback <- m.MsgType
+	})
+	router.HandleStatus(func(a *Actor, e *Event) {
+		if e.Status == Connected {
+			connected <- true
+		}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- router.ServeServer(ctx, sc)
+	}()
+
+	Sleep()
+
+	cc, err := StartClient(clientConfig("test_router"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	<-connected
+
+	//the slow handler shouldn't prevent the other messages from being handled
+	cc.Write(7, []byte("slow"))
+	cc.Write(9, []byte("unhandled"))
+	cc.Write(5, []byte("hello"))
+
+	if msgType := <-fallback; msgType != 9 {
+		t.Errorf("expected the fallback to handle type 9, got %d", msgType)
+	}
+
+	for {
+		m, err := cc.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.MsgType == 6 {
+			if string(m.Data) != "echo hello" {
+				t.Errorf("Got %q, Wanted %q", m.Data, "echo hello")
+			}
+			break
+		}
+	}
+
+	close(slow)
+	cancel()
+	if err = <-served; err != context.Canceled {
+		t.Errorf("expected serving to stop when the context was cancelled, got: %v", err)
+	}
+}
+
+func TestRouterMulti(t *testing.T) {
+
+	scon := serverConfig("test_router_multi")
+	scon.MultiClient = true
+	sc, err := StartServer(scon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	connected := make(chan int, 4)
+
+	router := NewRouter()
+	router.Handle(5, func(a *Actor, m *Message) {
+		a.Write(6, append([]byte("echo "), m.Data...))
+	})
+	router.HandleStatus(func(a *Actor, e *Event) {
+		if e.Status == Connected {
+			connected <- e.ClientId
+		}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	served := make(chan error, 1)
+	go func() {
+		served <- router.ServeServer(ctx, sc)
+	}()
+
+	Sleep()
+
+	for i := 0; i < 2; i++ {
+		cc, err := StartClient(clientConfig("test_router_multi"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cc.Close()
+
+		want := fmt.Sprintf("echo client %d", cc.ClientId)
+		cc.Write(5, []byte(fmt.Sprintf("client %d", cc.ClientId)))
+
+		for {
+			m, err := cc.Read()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.MsgType == 6 {
+				if string(m.Data) != want {
+					t.Errorf("Got %q, Wanted %q", m.Data, want)
+				}
+				break
+			}
+		}
+	}
+
+	//each client connecting is handled once
+	Sleep()
+	if len(connected) != 2 {
+		t.Errorf("expected 2 connected events to be handled, got %d", len(connected))
+	}
+
+	sc.Close()
+	select {
+	case <-served:
+	case <-time.After(2 * time.Second):
+		t.Error("expected serving to stop when the server was closed")
+	}
+}
+
+func TestClientReadClose(t *testing.T) {
+
+	sc, err := StartServer(serverConfig("test_clientReadClose"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	Sleep()
+
+	config := &ClientConfig{
+		Timeout:    3 * time.Second,
+		RetryTimer: 1 * time.Second,
+		Name:       "test_clientReadClose",
+		Encryption: ENCRYPT_BY_DEFAULT,
+	}
+
+	cc, err2 := StartClient(config)
+	if err2 != nil {
+		t.Error(err2)
+	}
+	defer cc.Close()
+
+	connected := make(chan bool, 1)
+	clientTimout := make(chan bool, 1)
+	clientConnected := make(chan bool, 1)
+	clientError := make(chan bool, 1)
+
+	go func() {
+
+		for {
+
+			m := <-sc.Events()
+			if m.Status == Connected {
+				connected <- true
+				break
+			}
+
+		}
+	}()
+
+	go func() {
+
+		reconnect := false
+
+		for {
+
+			m := <-cc.Events()
+
+			if m.Err == nil {
+				if m.Status == Connected {
+					clientConnected <- true
+				} else if m.Status == ReConnecting {
+					reconnect = true
+				} else if m.Status == Timeout && reconnect == true {
+					clientTimout <- true
+					break
+				}
+			}
+		}
+
+		_, err3 := cc.Read()
+		if err3 != nil {
+			log.Printf("err: %s", err3)
+			if err3.Error() == "the received channel has been closed" {
+				clientError <- true // after the connection times out the received channel is closed, so we're now testing that the close error is returned.
+				// This is the only error the received function returns.
+			}
+		}
+	}()
+
+	<-connected
+	<-clientConnected
 	//IMPORTANT Close was not placed here by mistake
 	sc.Close()
 	<-clientTimout
@@ -1472,7 +1768,7 @@ func TestServerReceiveWrongVersionNumber(t *testing.T) {
 
 		Sleep()
 		//cc.ClientId = 1
-		conn, err := cc.connect()
+		conn, err := cc.connect(context.Background())
 		if err != nil {
 			t.Error(err)
 		}
@@ -1484,7 +1780,7 @@ func TestServerReceiveWrongVersionNumber(t *testing.T) {
 			return
 		}
 
-		if recv[0] != 4 {
+		if recv[0] != VERSION+1 {
 			cc.handshakeSendReply(1)
 			return
 		}
@@ -1492,16 +1788,13 @@ func TestServerReceiveWrongVersionNumber(t *testing.T) {
 
 	for {
 
-		m, err := sc.Read()
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
+		e := <-sc.Events()
 
-		if m.Err != nil {
-			if m.Err.Error() != "client has a different VERSION number" {
+		if e.Err != nil {
+			if e.Err.Error() != "client has a different VERSION number" {
 				t.Error("should have error because server sent the client the wrong VERSION number 1")
 			}
+			return
 		}
 	}
 }
@@ -1526,7 +1819,7 @@ func TestServerReceiveWrongVersionNumberMulti(t *testing.T) {
 
 		Sleep()
 		cc.ClientId = 1
-		conn, err := cc.connect()
+		conn, err := cc.connect(context.Background())
 		if err != nil {
 			t.Error(err)
 		}
@@ -1538,7 +1831,7 @@ func TestServerReceiveWrongVersionNumberMulti(t *testing.T) {
 			return
 		}
 
-		if recv[0] != 4 {
+		if recv[0] != VERSION+1 {
 			cc.handshakeSendReply(1)
 			return
 		}
@@ -1546,16 +1839,13 @@ func TestServerReceiveWrongVersionNumberMulti(t *testing.T) {
 
 	for {
 
-		m, err := sc.Read()
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
+		e := <-sc.Events()
 
-		if m.Err != nil {
-			if m.Err.Error() != "client has a different VERSION number" {
+		if e.Err != nil {
+			if e.Err.Error() != "client has a different VERSION number" {
 				t.Error("should have error because server sent the client the wrong VERSION number 1")
 			}
+			return
 		}
 	}
 }
@@ -1584,25 +1874,25 @@ func TestServerWrongEncryption(t *testing.T) {
 
 	go func() {
 		for {
-			m, err := cc.Read()
-			cc.logger.Debugf("Message: %v, err %s", m, err)
-			if err != nil {
-				if err.Error() != "server tried to connect without encryption" && m.MsgType != -2 {
-					t.Error(err)
+			e := <-cc.Events()
+			cc.logger.Debugf("Event: %v", e)
+			if e.Err != nil {
+				if e.Err.Error() != "server tried to connect without encryption" {
+					t.Error(e.Err)
 				}
 				break
-			} else if m.Status == "Closed" {
+			} else if e.Status == Closed {
 				break
 			}
 		}
 	}()
 
 	for {
-		mm, err2 := sc.Read()
-		sc.logger.Debugf("Message: %v, err %s", mm, err)
-		if err2 != nil {
-			if err2.Error() != "client is enforcing encryption" && mm.MsgType != -2 {
-				t.Error(err2)
+		e := <-sc.Events()
+		sc.logger.Debugf("Event: %v", e)
+		if e.Err != nil {
+			if e.Err.Error() != "client is enforcing encryption" {
+				t.Error(e.Err)
 			}
 			break
 		}
@@ -1624,37 +1914,2450 @@ func TestServerWrongEncryption2(t *testing.T) {
 	ccon.Encryption = false
 	cc, err2 := StartClient(ccon)
 	defer cc.Close()
-	if err2 != nil {
-		if err2.Error() != "server tried to connect without encryption" {
-			t.Error(err2)
-		}
+	if err2 == nil || err2.Error() != "server is enforcing encryption" {
+		t.Errorf("expected the client to detect the encryption mismatch, got: %v", err2)
 	}
 
-	go func() {
-		for {
-			m, err := cc.Read()
-			cc.logger.Debugf("Message: %v, err %s", m, err)
-			if err != nil {
-				if err.Error() != "server tried to connect without encryption" {
-					if m != nil && m.MsgType != -2 {
-						t.Error(err)
-					}
-				}
-				break
-			} else if m.Status == "Closed" {
-				break
-			}
-		}
-	}()
-
 	for {
-		mm, err2 := sc.Read()
-		sc.logger.Debugf("Message: %v, err %s", mm, err2)
-		if err2 != nil {
-			if err2.Error() != "public key received isn't valid length 97, got: 1" {
-				t.Error(err2)
+		e := <-sc.Events()
+		sc.logger.Debugf("Event: %v", e)
+		if e.Err != nil {
+			if e.Err.Error() != "client isn't using encryption" {
+				t.Error(e.Err)
 			}
 			break
 		}
 	}
 }
+
+func TestEventsMulti(t *testing.T) {
+
+	scon := serverConfig("test_events_multi")
+	scon.MultiClient = true
+	sc, err := StartServer(scon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	Sleep()
+
+	for i := 1; i <= 2; i++ {
+		cc, err := StartClient(clientConfig("test_events_multi"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cc.Close()
+
+		//the events of each client server are also dispatched on the server
+		for {
+			e := <-sc.Events()
+			if e.Err == nil && e.Status == Connected {
+				if e.ClientId != cc.ClientId {
+					t.Errorf("expected the event of client %d, got %s", cc.ClientId, e)
+				}
+				break
+			}
+		}
+	}
+}
+
+func TestEventsDiscardOldest(t *testing.T) {
+
+	cc, err := NewClient("test_events_discard", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < EVENT_BUFFER_SIZE+5; i++ {
+		cc.dispatchErrorStr(fmt.Sprintf("error %d", i))
+	}
+
+	if len(cc.Events()) != EVENT_BUFFER_SIZE {
+		t.Fatalf("expected %d buffered events, got %d", EVENT_BUFFER_SIZE, len(cc.Events()))
+	}
+
+	e := <-cc.Events()
+	if e.Err.Error() != "error 5" {
+		t.Errorf("expected the oldest events to be discarded, got %s", e)
+	}
+}
+
+func TestBroadcastMulti(t *testing.T) {
+
+	scon := serverConfig("test_broadcast_multi")
+	scon.MultiClient = true
+	sc, err := StartServer(scon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	Sleep()
+
+	clients := make([]*Client, 3)
+	for i := range clients {
+		cc, err := StartClient(clientConfig("test_broadcast_multi"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cc.Close()
+		clients[i] = cc
+	}
+
+	for i := 0; len(sc.Connections.Clients()) != 3; i++ {
+		if i == 100 {
+			t.Fatalf("expected 3 connected clients, got %d", len(sc.Connections.Clients()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if errs := sc.Connections.Broadcast(5, []byte("to everyone")); len(errs) != 0 {
+		t.Errorf("expected the broadcast to succeed, got: %v", errs)
+	}
+
+	if err = sc.Connections.SendTo(2, 6, []byte("to client 2")); err != nil {
+		t.Error(err)
+	}
+
+	if err = sc.Connections.SendTo(99, 6, []byte("to nobody")); err == nil {
+		t.Error("sending to a ClientId which isn't in the pool should have returned an error")
+	}
+
+	for _, cc := range clients {
+		m, err := cc.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.MsgType != 5 || string(m.Data) != "to everyone" {
+			t.Errorf("client %d expected the broadcast, got %q", cc.ClientId, m.Data)
+		}
+	}
+
+	m, err := clients[1].Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.MsgType != 6 || string(m.Data) != "to client 2" {
+		t.Errorf("client 2 expected its message, got %q", m.Data)
+	}
+
+	if sc.Connections.Get(3) == nil {
+		t.Fatal("expected client 3 to be in the pool")
+	}
+
+	clients[2].Close()
+	for {
+		e := <-sc.Events()
+		if e.Err == nil && e.Status == Disconnected && e.ClientId == 3 {
+			break
+		}
+	}
+
+	//the disconnected client is skipped
+	if len(sc.Connections.Clients()) != 2 {
+		t.Errorf("expected 2 connected clients, got %d", len(sc.Connections.Clients()))
+	}
+	if errs := sc.Connections.Broadcast(5, []byte("to everyone left")); len(errs) != 0 {
+		t.Errorf("expected the broadcast to succeed, got: %v", errs)
+	}
+	if err = sc.Connections.SendTo(3, 6, []byte("to client 3")); err == nil {
+		t.Error("sending to a disconnected client should have returned an error")
+	}
+}
+
+func TestMaxClientsMulti(t *testing.T) {
+
+	scon := serverConfig("test_max_clients_multi")
+	scon.MultiClient = true
+	scon.MaxClients = 2
+	sc, err := StartServer(scon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	Sleep()
+
+	clients := make([]*Client, 2)
+	for i := range clients {
+		cc, err := StartClient(clientConfig("test_max_clients_multi"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cc.Close()
+		clients[i] = cc
+	}
+
+	_, err = StartClient(clientConfig("test_max_clients_multi"))
+	if err == nil || err.Error() != "server has reached the maximum number of clients" {
+		t.Fatalf("expected the third client to be rejected, got: %v", err)
+	}
+
+	evicted := sc.Connections.Get(1)
+	if evicted == nil {
+		t.Fatal("expected client 1 to be in the pool")
+	}
+
+	clients[0].Close()
+
+	//the disconnected client server is evicted from the pool
+	for i := 0; len(sc.Connections.getServers()) != 1; i++ {
+		if i == 100 {
+			t.Fatalf("expected 1 client server, got %d", len(sc.Connections.getServers()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err = evicted.Read(); err == nil {
+		t.Error("reading from an evicted client server should have returned an error")
+	}
+
+	//the ClientId of the evicted client is reused
+	cc, err := StartClient(clientConfig("test_max_clients_multi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	if cc.ClientId != 1 {
+		t.Errorf("expected the ClientId 1 to be reused, got %d", cc.ClientId)
+	}
+}
+
+type codecTestValue struct {
+	Name  string
+	Count int
+	Tags  []string
+}
+
+func TestWriteReadValue(t *testing.T) {
+
+	for _, codec := range []Codec{nil, GobCodec{}} {
+
+		scon := serverConfig("test_codec")
+		scon.Codec = codec
+		sc, err := StartServer(scon)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		Sleep()
+
+		ccon := clientConfig("test_codec")
+		ccon.Codec = codec
+		cc, err := StartClient(ccon)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := codecTestValue{Name: "value", Count: 3, Tags: []string{"a", "b"}}
+		if err = cc.WriteValue(5, want); err != nil {
+			t.Fatal(err)
+		}
+
+		var got codecTestValue
+		m, err := sc.ReadValue(&got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.MsgType != 5 || got.Name != want.Name || got.Count != want.Count || strings.Join(got.Tags, ",") != "a,b" {
+			t.Errorf("%s codec: got %+v, wanted %+v", sc.codec.Name(), got, want)
+		}
+
+		cc.Close()
+		sc.Close()
+	}
+}
+
+func TestCodecMismatch(t *testing.T) {
+
+	sc, err := StartServer(serverConfig("test_codec_mismatch"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	Sleep()
+
+	ccon := clientConfig("test_codec_mismatch")
+	ccon.Codec = GobCodec{}
+	_, err = StartClient(ccon)
+	if err == nil || err.Error() != "server is using a different codec: json" {
+		t.Errorf("expected the client to fail with a codec mismatch, got: %v", err)
+	}
+
+	for {
+		e := <-sc.Events()
+		if e.Err != nil {
+			if e.Err.Error() != "client is using a different codec" {
+				t.Errorf("expected the server to fail with a codec mismatch, got: %s", e.Err)
+			}
+			break
+		}
+	}
+}
+
+type typedRequest struct {
+	A, B int
+}
+
+type typedResponse struct {
+	Sum int
+}
+
+func TestTypedClientServer(t *testing.T) {
+
+	sc, err := StartServer(serverConfig("test_typed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	Sleep()
+
+	cc, err := StartClient(clientConfig("test_typed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	ts := NewTypedServer[typedRequest, typedResponse](sc)
+	tc := NewTypedClient[typedRequest, typedResponse](cc)
+
+	go func() {
+		for {
+			request, err := ts.Recv()
+			if err != nil {
+				return
+			}
+			ts.Send(typedResponse{Sum: request.A + request.B})
+		}
+	}()
+
+	for i := 1; i <= 3; i++ {
+		if err = tc.Send(typedRequest{A: i, B: 10}); err != nil {
+			t.Fatal(err)
+		}
+		response, err := tc.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.Sum != i+10 {
+			t.Errorf("Got %d, Wanted %d", response.Sum, i+10)
+		}
+	}
+
+	//a message of another type isn't decoded
+	sc.Write(TYPED_MSG_TYPE+1, []byte("untyped"))
+	if _, err = tc.Recv(); err == nil {
+		t.Error("receiving a message of another type should have returned an error")
+	}
+}
+
+func TestStream(t *testing.T) {
+
+	scon := serverConfig("test_stream")
+	scon.MaxMsgSize = 64 * 1024
+	sc, err := StartServer(scon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	Sleep()
+
+	cc, err := StartClient(clientConfig("test_stream"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	//larger than the maximum message size so it is split into many chunks
+	payload := make([]byte, 5*1024*1024+123)
+	for i := range payload {
+		payload[i] = byte(i % 251)
+	}
+
+	go func() {
+		w, err := cc.OpenStream(5)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		for i := 0; i < len(payload); i += 100000 {
+			if _, err = w.Write(payload[i:min(i+100000, len(payload))]); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+		if err = w.Close(); err != nil {
+			t.Error(err)
+		}
+
+		w, _ = cc.OpenStream(6)
+		w.Write([]byte("partial"))
+		w.CloseWithError(errors.New("the snapshot failed"))
+	}()
+
+	m, err := sc.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.MsgType != 5 || m.Stream == nil {
+		t.Fatalf("expected a stream of type 5, got %+v", m)
+	}
+	received, err := io.ReadAll(m.Stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, payload) {
+		t.Errorf("received %d bytes which don't match the %d bytes sent", len(received), len(payload))
+	}
+
+	m, err = sc.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadAll(m.Stream)
+	if err == nil || err.Error() != "the snapshot failed" {
+		t.Errorf("expected the stream to fail, got: %v", err)
+	}
+}
+
+func TestStreamIntegrity(t *testing.T) {
+
+	cc, err := NewClient("test_stream_integrity", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//a stream whose checksum doesn't match the data received
+	end := make([]byte, streamEndLen)
+	end[7] = 4
+	go cc.receiveStream(&frame{msgType: 5, flags: frameChunk, requestId: 1, data: []byte("data")})
+
+	m, _ := cc.Read()
+	go cc.receiveStream(&frame{msgType: 5, flags: frameStreamEnd, requestId: 1, data: end})
+
+	_, err = io.ReadAll(m.Stream)
+	if err == nil || err.Error() != "stream integrity check failed" {
+		t.Errorf("expected the integrity check to fail, got: %v", err)
+	}
+}
+
+func TestStreamBeforeHandshake(t *testing.T) {
+
+	cc, err := NewClient("test_stream_before_handshake", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := cc.OpenStream(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the maximum message size isn't known until the handshake
+	written := make(chan error, 1)
+	go func() {
+		_, err := w.Write([]byte("data"))
+		written <- err
+	}()
+
+	select {
+	case err = <-written:
+		if err == nil {
+			t.Error("expected writing to the stream before the handshake to return an error")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("writing to the stream before the handshake didn't return")
+	}
+}
+
+func TestStreamWindow(t *testing.T) {
+
+	scon := serverConfig("test_stream_window")
+	scon.MaxMsgSize = 1024
+	sc, err := StartServer(scon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	Sleep()
+
+	cc, err := StartClient(clientConfig("test_stream_window"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	payload := bytes.Repeat([]byte("window"), 10*1024)
+
+	go func() {
+		w, err := cc.OpenStream(5)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		w.Write(payload)
+		w.Close()
+	}()
+
+	m, err := sc.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the stream isn't read yet, its writer waits for credits rather than holding up the connection
+	cc.Write(6, []byte("after the stream"))
+	m2, err := sc.Read()
+	if err != nil || string(m2.Data) != "after the stream" {
+		t.Fatalf("expected the message written after the stream, got %v %v", m2, err)
+	}
+
+	received, err := io.ReadAll(m.Stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, payload) {
+		t.Errorf("received %d bytes which don't match the %d bytes sent", len(received), len(payload))
+	}
+}
+
+func TestStreamOverrun(t *testing.T) {
+
+	cc, err := NewClient("test_stream_overrun", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//a writer ignoring its window has its stream aborted rather than blocking the connection
+	go func() {
+		for i := 0; i <= STREAM_BUFFER_SIZE+1; i++ {
+			cc.receiveStream(&frame{msgType: 5, flags: frameChunk, requestId: 1, data: []byte("data")})
+		}
+	}()
+
+	m, _ := cc.Read()
+
+	_, err = io.ReadAll(m.Stream)
+	if err != ErrStreamOverrun {
+		t.Errorf("expected the stream to be aborted, got: %v", err)
+	}
+	if !overrunDispatched(cc.Events()) {
+		t.Error("expected the overrun to be dispatched")
+	}
+}
+
+func overrunDispatched(events <-chan *Event) bool {
+	for {
+		select {
+		case e := <-events:
+			if e.Err == ErrStreamOverrun {
+				return true
+			}
+		case <-time.After(time.Second):
+			return false
+		}
+	}
+}
+
+func TestNetConn(t *testing.T) {
+
+	sc, err := StartServer(serverConfig("test_net_conn"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	Sleep()
+
+	cc, err := StartClient(clientConfig("test_net_conn"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	//a line protocol echoing each line it reads in upper case
+	serverDone := make(chan error, 1)
+	go func() {
+		conn := sc.NetConn()
+		defer conn.Close()
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			fmt.Fprintf(conn, "%s\n", strings.ToUpper(scanner.Text()))
+		}
+		serverDone <- scanner.Err()
+	}()
+
+	conn := cc.NetConn()
+	reader := bufio.NewReader(conn)
+
+	//regular messages are still delivered alongside the net.Conn, as long as they are read
+	received := make(chan *Message, 1)
+	go func() {
+		m, _ := cc.Read()
+		received <- m
+	}()
+	sc.Write(5, []byte("not tunnelled"))
+
+	for _, line := range []string{"hello", "over the ipc connection"} {
+		fmt.Fprintf(conn, "%s\n", line)
+		got, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != strings.ToUpper(line)+"\n" {
+			t.Errorf("Got %q, Wanted %q", got, strings.ToUpper(line)+"\n")
+		}
+	}
+
+	if m := <-received; m == nil || string(m.Data) != "not tunnelled" {
+		t.Errorf("expected the regular message, got %v", m)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err = reader.ReadString('\n'); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expected the read deadline to be exceeded, got: %v", err)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	//closing the client side ends the scanner of the server with io.EOF
+	conn.Close()
+	if err = <-serverDone; err != nil {
+		t.Errorf("expected the server to read until io.EOF, got: %v", err)
+	}
+	if _, err = conn.Write([]byte("closed\n")); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("expected writing to a closed net.Conn to fail, got: %v", err)
+	}
+}
+
+func TestNetConnWindow(t *testing.T) {
+
+	scon := serverConfig("test_net_conn_window")
+	scon.MaxMsgSize = 1024
+	sc, err := StartServer(scon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	Sleep()
+
+	cc, err := StartClient(clientConfig("test_net_conn_window"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	payload := bytes.Repeat([]byte("tunnel"), 10*1024)
+
+	written := make(chan error, 1)
+	go func() {
+		conn := cc.NetConn()
+		_, err := conn.Write(payload)
+		conn.Close()
+		written <- err
+	}()
+
+	//the net.Conn of the server isn't read yet, regular messages are still delivered
+	cc.Write(6, []byte("beside the tunnel"))
+	m, err := sc.Read()
+	if err != nil || string(m.Data) != "beside the tunnel" {
+		t.Fatalf("expected the message written beside the tunnel, got %v %v", m, err)
+	}
+
+	received, err := io.ReadAll(sc.NetConn())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, payload) {
+		t.Errorf("received %d bytes which don't match the %d bytes sent", len(received), len(payload))
+	}
+	if err = <-written; err != nil {
+		t.Errorf("expected the write to complete, got: %v", err)
+	}
+}
+
+func TestNetConnOverrun(t *testing.T) {
+
+	cc, err := NewClient("test_net_conn_overrun", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := cc.getTunnel()
+	for i := 0; i <= STREAM_BUFFER_SIZE; i++ {
+		conn.receive(&frame{flags: frameConn, data: []byte("data")})
+	}
+
+	if !overrunDispatched(cc.Events()) {
+		t.Error("expected the overrun to be dispatched")
+	}
+
+	received, err := io.ReadAll(conn)
+	if err != nil || len(received) != STREAM_BUFFER_SIZE*4 {
+		t.Errorf("expected the data received before the overrun, got %d bytes: %v", len(received), err)
+	}
+}
+
+func TestNetConnBeforeHandshake(t *testing.T) {
+
+	cc, err := NewClient("test_net_conn_before_handshake", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the maximum message size isn't known until the handshake
+	written := make(chan error, 1)
+	go func() {
+		_, err := cc.NetConn().Write([]byte("data"))
+		written <- err
+	}()
+
+	select {
+	case err = <-written:
+		if err == nil {
+			t.Error("expected writing to the net.Conn before the handshake to return an error")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("writing to the net.Conn before the handshake didn't return")
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+
+	scon := serverConfig("test_heartbeat")
+	scon.HeartbeatInterval = 20 * time.Millisecond
+	sc, err := StartServer(scon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	Sleep()
+
+	cc, err := StartClient(clientConfig("test_heartbeat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	if cc.heartbeatInterval != scon.HeartbeatInterval {
+		t.Errorf("expected the client to use the heartbeat interval of the server, got %s", cc.heartbeatInterval)
+	}
+
+	//the heartbeats keep an idle connection alive
+	time.Sleep(200 * time.Millisecond)
+	if sc.getStatus() != Connected || cc.getStatus() != Connected {
+		t.Errorf("expected an idle connection to remain connected, got %s and %s", sc.Status(), cc.Status())
+	}
+}
+
+func TestHeartbeatWhileNotReading(t *testing.T) {
+
+	scon := serverConfig("test_heartbeat_not_reading")
+	scon.HeartbeatInterval = 50 * time.Millisecond
+	sc, err := StartServer(scon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	Sleep()
+
+	cc, err := StartClient(clientConfig("test_heartbeat_not_reading"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	//the message waiting to be read holds up the heartbeats of the client, which is still alive
+	waitForStatus(&sc.Actor, Connected)
+	if err = cc.Write(5, []byte("unread")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(600 * time.Millisecond)
+
+	if sc.getStatus() != Connected || cc.getStatus() != Connected {
+		t.Errorf("expected the connection to remain connected while the server isn't reading, got %s and %s", sc.Status(), cc.Status())
+	}
+
+	m, err := sc.Read()
+	if err != nil || string(m.Data) != "unread" {
+		t.Errorf("expected the unread message, got %v %v", m, err)
+	}
+}
+
+func TestHeartbeatServerDetectsHungClient(t *testing.T) {
+
+	scon := serverConfig("test_heartbeat_client")
+	scon.HeartbeatInterval = 20 * time.Millisecond
+	sc, err := StartServer(scon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	Sleep()
+
+	//a client which completes the handshake and then stops responding
+	cc, err := NewClient("test_heartbeat_client", clientConfig("test_heartbeat_client"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := cc.connect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	cc.setConn(conn)
+	if err = cc.handshake(); err != nil {
+		t.Fatal(err)
+	}
+
+	waitForStatus(&sc.Actor, Connected)
+	waitForStatus(&sc.Actor, Timeout)
+	waitForStatus(&sc.Actor, Disconnected)
+}
+
+func TestHeartbeatClientDetectsHungServer(t *testing.T) {
+
+	//a server which completes the handshake and then stops responding
+	scon := serverConfig("test_heartbeat_server")
+	scon.HeartbeatInterval = 20 * time.Millisecond
+	hung, err := NewServer("test_heartbeat_server", scon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = hung.listen(); err != nil {
+		t.Fatal(err)
+	}
+	defer hung.listener.Close()
+
+	go func() {
+		conn, err := hung.listener.Accept()
+		if err != nil {
+			return
+		}
+		hung.setConn(conn)
+		hung.handshake()
+	}()
+
+	ccon := clientConfig("test_heartbeat_server")
+	ccon.RetryTimer = 50 * time.Millisecond
+	cc, err := StartClient(ccon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	waitForStatus(&cc.Actor, Timeout)
+	waitForStatus(&cc.Actor, ReConnecting)
+}
+
+func TestConnectionEnded(t *testing.T) {
+
+	cc, err := NewClient("test_connection_ended", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//a half-open connection given up on by keepalive must reconnect like one which was closed
+	for _, err := range []error{
+		io.EOF,
+		&net.OpError{Op: "read", Err: syscall.ETIMEDOUT},
+		&net.OpError{Op: "read", Err: syscall.EPIPE},
+		errors.New("remote error: tls: bad record MAC"),
+	} {
+		if !cc.connectionEnded(err) {
+			t.Errorf("expected %v to end the connection", err)
+		}
+	}
+
+	if cc.connectionEnded(&net.OpError{Op: "read", Err: os.ErrDeadlineExceeded}) {
+		t.Error("expected a read deadline passing not to end the connection")
+	}
+}
+
+func TestReconnectPolicyDelay(t *testing.T) {
+
+	policy := getReconnectPolicy(&ReconnectPolicy{Multiplier: 2, MaxDelay: time.Second}, 100*time.Millisecond)
+
+	for attempt, want := range []time.Duration{100, 100, 200, 400, 800, 1000, 1000} {
+		if got := policy.delay(attempt); got != want*time.Millisecond {
+			t.Errorf("attempt %d: Got %s, Wanted %s", attempt, got, want*time.Millisecond)
+		}
+	}
+
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if got := policy.delay(1); got < 50*time.Millisecond || got > 150*time.Millisecond {
+			t.Fatalf("expected the delay to be within the jitter, got %s", got)
+		}
+	}
+
+	//a jitter above 1 is clamped so the delay is never negative
+	policy = getReconnectPolicy(&ReconnectPolicy{Jitter: 5}, 100*time.Millisecond)
+	for i := 0; i < 100; i++ {
+		if got := policy.delay(1); got < 0 || got > 200*time.Millisecond {
+			t.Fatalf("expected the delay to be within the clamped jitter, got %s", got)
+		}
+	}
+
+	//the RetryTimer is waited forever by default
+	if policy = getReconnectPolicy(nil, time.Second); policy.delay(10) != time.Second || policy.allow(1000, nil) != nil {
+		t.Error("expected the default policy to retry every RetryTimer forever")
+	}
+}
+
+func TestReconnectPolicyMaxAttempts(t *testing.T) {
+
+	ccon := clientConfig("test_reconnect_policy")
+	ccon.ReconnectPolicy = &ReconnectPolicy{InitialDelay: 10 * time.Millisecond, Multiplier: 2, MaxAttempts: 3}
+
+	start := time.Now()
+	_, err := StartClient(ccon)
+	if err == nil || err.Error() != "gave up connecting after 3 attempts" {
+		t.Fatalf("expected the client to give up, got: %v", err)
+	}
+
+	//the client waited 10ms and then 20ms between its attempts
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Errorf("expected the client to back off between attempts, took %s", elapsed)
+	}
+}
+
+func TestReconnectPolicyVeto(t *testing.T) {
+
+	sc, err := StartServer(serverConfig("test_reconnect_veto"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Sleep()
+
+	vetoed := make(chan bool, 1)
+	ccon := clientConfig("test_reconnect_veto")
+	ccon.ReconnectPolicy = &ReconnectPolicy{
+		InitialDelay: 10 * time.Millisecond,
+		ShouldReconnect: func(attempt int, err error) bool {
+			vetoed <- attempt == 0 && err == nil
+			return false
+		},
+	}
+	cc, err := StartClient(ccon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	waitForStatus(&cc.Actor, Connected)
+	sc.Close()
+
+	if !<-vetoed {
+		t.Error("expected the hook to be called before reconnecting")
+	}
+	for {
+		e := <-cc.Events()
+		if e.Err != nil {
+			if e.Err.Error() != "connecting again was vetoed by the reconnect policy" {
+				t.Errorf("expected the reconnect to be vetoed, got: %s", e.Err)
+			}
+			break
+		}
+	}
+}
+
+func TestOutboundBuffer(t *testing.T) {
+
+	sc, err := StartServer(serverConfig("test_outbound_buffer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Sleep()
+
+	ccon := clientConfig("test_outbound_buffer")
+	ccon.RetryTimer = 20 * time.Millisecond
+	ccon.OutboundBuffer = 3
+	ccon.OutboundPolicy = BufferDropNewest
+	cc, err := StartClient(ccon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	waitForStatus(&cc.Actor, Connected)
+	sc.Close()
+	waitForStatus(&cc.Actor, ReConnecting)
+
+	//the writes are buffered while the client is reconnecting
+	for i := 1; i <= 3; i++ {
+		if err = cc.Write(5, []byte(fmt.Sprintf("buffered %d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = cc.Write(5, []byte("dropped")); err == nil || err.Error() != "the outbound buffer is full" {
+		t.Fatalf("expected the buffer to be full, got: %v", err)
+	}
+
+	sc2, err := StartServer(serverConfig("test_outbound_buffer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc2.Close()
+
+	waitForStatus(&cc.Actor, Connected)
+	if err = cc.Write(5, []byte("connected")); err != nil {
+		t.Fatal(err)
+	}
+
+	//the buffered messages are flushed in order before the messages written once connected
+	for _, want := range []string{"buffered 1", "buffered 2", "buffered 3", "connected"} {
+		m, err := sc2.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(m.Data) != want {
+			t.Errorf("Got %s, Wanted %s", m.Data, want)
+		}
+	}
+}
+
+func TestOutboundBufferWindow(t *testing.T) {
+
+	sc, err := StartServer(serverConfig("test_outbound_window"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Sleep()
+
+	ccon := clientConfig("test_outbound_window")
+	ccon.RetryTimer = 20 * time.Millisecond
+	ccon.OutboundBuffer = 4
+	cc, err := StartClient(ccon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	waitForStatus(&cc.Actor, Connected)
+	sc.Close()
+	waitForStatus(&cc.Actor, ReConnecting)
+
+	for i := 1; i <= 4; i++ {
+		if err = cc.Write(5, []byte(fmt.Sprintf("buffered %d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	scon := serverConfig("test_outbound_window")
+	scon.ReceiveBuffer = 2
+	sc2, err := StartServer(scon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc2.Close()
+
+	//the buffered messages use the window of the new server, which isn't reading yet
+	time.Sleep(200 * time.Millisecond)
+	if stats := cc.Stats(); stats.Window != 2 || stats.Credits != 0 {
+		t.Errorf("expected the flushed messages to use the window, got %+v", stats)
+	}
+
+	for i := 1; i <= 4; i++ {
+		m, err := sc2.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("buffered %d", i); string(m.Data) != want {
+			t.Errorf("Got %s, Wanted %s", m.Data, want)
+		}
+	}
+	waitForStatus(&cc.Actor, Connected)
+}
+
+func TestOutboundBufferPolicies(t *testing.T) {
+
+	cc, err := NewClient("test_outbound_policies", clientConfig("test_outbound_policies"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc.setStatus(ReConnecting)
+
+	cc.outbox = newOutbox(2, BufferDropOldest)
+	for i := 1; i <= 3; i++ {
+		if err = cc.Write(5, []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(cc.outbox.frames) != 2 || cc.outbox.frames[0].data[0] != 2 || cc.outbox.frames[1].data[0] != 3 {
+		t.Error("expected the oldest message to be dropped")
+	}
+
+	cc.outbox = newOutbox(1, BufferBlock)
+	if err = cc.Write(5, []byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err = cc.WriteContext(ctx, 5, []byte{2}); err != context.DeadlineExceeded {
+		t.Errorf("expected the write to block until the context is done, got: %v", err)
+	}
+
+	//a blocked write is queued once the buffer is flushed
+	written := make(chan error)
+	go func() {
+		written <- cc.Write(5, []byte{3})
+	}()
+	go func() {
+		for f := range cc.toWrite {
+			if f.data[0] == 3 {
+				return
+			}
+		}
+	}()
+	cc.maxMsgSize = MAX_MSG_SIZE
+	cc.outbox.flush(cc)
+	if err = <-written; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSessionSequencing(t *testing.T) {
+
+	s := newSession()
+
+	frames := []*frame{{msgType: 5}, {msgType: 0, flags: frameHeartbeat}, {msgType: 5, flags: frameChunk}, {msgType: 5}}
+	for _, f := range frames {
+		s.send(f)
+	}
+
+	//only the messages which aren't control frames or streams are numbered
+	if frames[0].seq != 1 || frames[1].seq != 0 || frames[2].seq != 0 || frames[3].seq != 2 {
+		t.Errorf("unexpected seqs: %d %d %d %d", frames[0].seq, frames[1].seq, frames[2].seq, frames[3].seq)
+	}
+
+	s.acknowledged(1)
+	if pending := s.pending(); len(pending) != 1 || pending[0] != frames[3] {
+		t.Error("expected only the unacknowledged message to be pending")
+	}
+
+	//a replayed message keeps its seq
+	s.send(frames[3])
+	if frames[3].seq != 2 || len(s.pending()) != 1 {
+		t.Error("expected the replayed message to keep its seq")
+	}
+
+	received := &frame{msgType: 5, seq: 1}
+	if s.duplicate(received) {
+		t.Error("the message hasn't been received yet")
+	}
+	s.delivered(received)
+	if !s.duplicate(received) || !s.pendingAck() {
+		t.Error("expected the message to be a duplicate once delivered and to need acknowledging")
+	}
+
+	//the next frame sent acknowledges it
+	ack := &frame{}
+	s.send(ack)
+	if ack.ack != 1 || s.pendingAck() {
+		t.Error("expected the frame to acknowledge the message received")
+	}
+
+	if lost := s.reset([]byte("token")); lost != 1 || len(s.pending()) != 0 || s.duplicate(received) {
+		t.Error("expected a new session to discard the unacknowledged message")
+	}
+}
+
+// testSessionResume - the client stops reading so the messages written by the server
+// aren't acknowledged, then loses its connection before reading them
+func testSessionResume(t *testing.T, sc *Server, cc *Client, write func([]byte) error) {
+
+	for i := 1; i <= 5; i++ {
+		if err := write([]byte(fmt.Sprintf("message %d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	Sleep()
+
+	cc.getConn().Close()
+	waitForStatus(&sc.Actor, Disconnected)
+
+	//the messages the client didn't receive are replayed once it has resumed the session
+	for i := 1; i <= 5; i++ {
+		m, err := cc.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("message %d", i); string(m.Data) != want {
+			t.Fatalf("Got %s, Wanted %s", m.Data, want)
+		}
+	}
+
+	m, err := cc.ReadTimed(100 * time.Millisecond)
+	if err != nil || m != TimeoutMessage {
+		t.Errorf("expected no more messages, got: %v %v", m, err)
+	}
+}
+
+func TestSessionReplayOrder(t *testing.T) {
+
+	cc, err := NewClient("test_session_replay_order", &ClientConfig{SendBuffer: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//two messages were written to the lost connection and a third was queued afterwards
+	for i := 1; i <= 2; i++ {
+		cc.session.send(&frame{msgType: 5, data: []byte(fmt.Sprintf("replayed %d", i))})
+	}
+	cc.toWriteHigh <- &frame{msgType: 5, data: []byte("new"), priority: PriorityHigh}
+	cc.session.rewind()
+	cc.flow.reset(1)
+
+	lanes := map[byte]*writeLane{
+		laneHigh:   {id: laneHigh, queue: cc.toWriteHigh},
+		laneNormal: {id: laneNormal, queue: cc.toWrite},
+		laneLow:    {id: laneLow, queue: cc.toWriteLow},
+		laneReplay: {id: laneReplay},
+	}
+	turn := 0
+
+	next := make(chan *frame, 1)
+	go func() {
+		for {
+			f, _ := cc.nextFrame(lanes, &turn)
+			next <- f
+			if f == nil {
+				return
+			}
+		}
+	}()
+	defer cc.Close()
+
+	if f := <-next; string(f.data) != "replayed 1" || f.seq != 1 {
+		t.Fatalf("expected the first message to be replayed, got %s (%d)", f.data, f.seq)
+	}
+
+	//the second waits for a credit and the new message doesn't overtake it
+	select {
+	case f := <-next:
+		t.Fatalf("expected the writer to wait for a credit, got %s", f.data)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cc.flow.grant(1)
+	for i, want := range []string{"replayed 2", "new"} {
+		if f := <-next; string(f.data) != want || f.seq != uint32(i+2) {
+			t.Errorf("Got %s (%d), Wanted %s", f.data, f.seq, want)
+		}
+		cc.flow.grant(1)
+	}
+}
+
+func TestSessionResume(t *testing.T) {
+
+	sc, err := StartServer(serverConfig("test_session_resume"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	Sleep()
+
+	ccon := clientConfig("test_session_resume")
+	ccon.RetryTimer = 20 * time.Millisecond
+	cc, err := StartClient(ccon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	waitForStatus(&sc.Actor, Connected)
+
+	testSessionResume(t, sc, cc, func(data []byte) error {
+		return sc.Write(5, data)
+	})
+}
+
+func TestSessionOwner(t *testing.T) {
+
+	sc, err := NewServer("test_session_owner", &ServerConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc.keyId = "a"
+	sc.setPeerCredentials(&PeerCredentials{UID: 1000, GID: 1000, PID: 42})
+	owner := sc.sessionOwner()
+
+	pool := &ConnectionPool{mutex: &sync.Mutex{}, sessions: make(map[string]*session)}
+	s := newSession()
+	s.reset([]byte("token"))
+	s.setOwner(owner)
+	pool.sessions["token"] = s
+
+	//a client with another pre-shared key or process can't take over the session
+	sc.keyId = "b"
+	if pool.takeSession([]byte("token"), sc.sessionOwner()) != nil {
+		t.Error("expected a client with another pre-shared key not to resume the session")
+	}
+	sc.keyId = "a"
+	sc.setPeerCredentials(&PeerCredentials{UID: 1001, GID: 1000, PID: 43})
+	if pool.takeSession([]byte("token"), sc.sessionOwner()) != nil {
+		t.Error("expected another process not to resume the session")
+	}
+
+	if pool.takeSession([]byte("token"), owner) != s {
+		t.Error("expected the client the session was created for to resume it")
+	}
+}
+
+func TestSessionResumeMulti(t *testing.T) {
+
+	scon := serverConfig("test_session_resume_multi")
+	scon.MultiClient = true
+	sc, err := StartServer(scon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	Sleep()
+
+	ccon := clientConfig("test_session_resume_multi")
+	ccon.RetryTimer = 20 * time.Millisecond
+	cc, err := StartClient(ccon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	waitForStatus(&sc.Actor, Connected)
+
+	testSessionResume(t, sc, cc, func(data []byte) error {
+		return sc.Connections.SendTo(cc.ClientId, 5, data)
+	})
+}
+
+func TestDurableOutbox(t *testing.T) {
+
+	config := DurableOutbox{Dir: t.TempDir(), SegmentSize: 64}
+
+	o, err := openDurableOutbox(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 5; i++ {
+		if err = o.append(&frame{msgType: 5, flags: frameRequest, requestId: uint32(i), data: []byte(fmt.Sprintf("message %d", i))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = o.ack(2); err != nil {
+		t.Fatal(err)
+	}
+	o.close()
+
+	//the process crashed while appending to the last segment
+	paths, _ := os.ReadDir(config.Dir)
+	last, err := os.OpenFile(config.Dir+"/"+paths[len(paths)-1].Name(), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last.Write([]byte{0, 0, 0, 100, 1, 2})
+	last.Close()
+
+	o, err = openDurableOutbox(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.close()
+
+	frames := o.frames()
+	if len(frames) != 3 {
+		t.Fatalf("expected the 3 messages which weren't acknowledged, got %d", len(frames))
+	}
+	for i, f := range frames {
+		if f.outboxId != uint64(i+3) || f.requestId != uint32(i+3) || f.flags != frameRequest || string(f.data) != fmt.Sprintf("message %d", i+3) {
+			t.Errorf("unexpected message %d: %+v", i, f)
+		}
+	}
+
+	if err = o.append(&frame{msgType: 5, data: []byte("message 6")}); err != nil || o.lastId != 6 {
+		t.Fatalf("expected the ids to continue after a restart, got %d: %v", o.lastId, err)
+	}
+
+	//the segments whose messages have all been acknowledged are removed
+	if err = o.ack(6); err != nil {
+		t.Fatal(err)
+	}
+	if paths, _ = os.ReadDir(config.Dir); len(paths) != 1 {
+		t.Errorf("expected a single segment once every message is acknowledged, got %d", len(paths))
+	}
+}
+
+func TestDurableOutboxDrop(t *testing.T) {
+
+	config := DurableOutbox{Dir: t.TempDir()}
+
+	o, err := openDurableOutbox(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		if err = o.append(&frame{msgType: 5, data: []byte(fmt.Sprintf("message %d", i))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//a message dropped from the outbound buffer isn't written after a restart
+	if err = o.drop(2); err != nil {
+		t.Fatal(err)
+	}
+	o.close()
+
+	o, err = openDurableOutbox(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.close()
+
+	frames := o.frames()
+	if len(frames) != 2 || frames[0].outboxId != 1 || frames[1].outboxId != 3 {
+		t.Errorf("expected messages 1 and 3, got %+v", frames)
+	}
+}
+
+func TestDurableOutboxRestart(t *testing.T) {
+
+	dir := t.TempDir()
+
+	sc, err := StartServer(serverConfig("test_durable_outbox"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Sleep()
+
+	ccon := clientConfig("test_durable_outbox")
+	ccon.DurableOutbox = &DurableOutbox{Dir: dir}
+	cc, err := StartClient(ccon)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the server doesn't read the messages so they aren't acknowledged before the client stops
+	for i := 1; i <= 3; i++ {
+		if err = cc.Write(5, []byte(fmt.Sprintf("message %d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	Sleep()
+	cc.Close()
+	sc.Close()
+
+	sc2, err := StartServer(serverConfig("test_durable_outbox"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc2.Close()
+
+	Sleep()
+
+	ccon = clientConfig("test_durable_outbox")
+	ccon.DurableOutbox = &DurableOutbox{Dir: dir}
+	cc2, err := StartClient(ccon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc2.Close()
+
+	if err = cc2.Write(5, []byte("message 4")); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= 4; i++ {
+		m, err := sc2.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("message %d", i); string(m.Data) != want {
+			t.Fatalf("Got %s, Wanted %s", m.Data, want)
+		}
+	}
+
+	//the messages are removed from the outbox once acknowledged
+	for start := time.Now(); len(cc2.durable.frames()) > 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatalf("expected the outbox to be empty, %d messages remain", len(cc2.durable.frames()))
+		}
+	}
+}
+
+func TestFlowControl(t *testing.T) {
+
+	scon := serverConfig("test_flow_control")
+	scon.ReceiveBuffer = 4
+	scon.HeartbeatInterval = 20 * time.Millisecond
+	sc, err := StartServer(scon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	Sleep()
+
+	ccon := clientConfig("test_flow_control")
+	ccon.FlowPolicy = FlowError
+	cc, err := StartClient(ccon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	waitForStatus(&sc.Actor, Connected)
+
+	for i := 1; i <= 4; i++ {
+		if err = cc.Write(5, []byte(fmt.Sprintf("message %d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = cc.Write(5, []byte("message 5")); err == nil || err.Error() != "the receive window of the other side is full" {
+		t.Fatalf("expected the window of the server to be full, got: %v", err)
+	}
+	if stats := cc.Stats(); stats.Window != 4 || stats.Credits != 0 {
+		t.Errorf("unexpected client stats: %+v", stats)
+	}
+
+	//the server keeps reading heartbeats while its messages aren't read
+	time.Sleep(100 * time.Millisecond)
+	if stats := sc.Stats(); stats.Received != 4 || stats.ReceiveBuffer != 4 || sc.StatusCode() != Connected {
+		t.Errorf("unexpected server stats: %+v %s", stats, sc.Status())
+	}
+
+	//reading half the window grants the credits back to the client
+	for i := 1; i <= 2; i++ {
+		if m, err := sc.Read(); err != nil || string(m.Data) != fmt.Sprintf("message %d", i) {
+			t.Fatalf("unexpected message: %v %v", m, err)
+		}
+	}
+	for start := time.Now(); cc.Stats().Credits != 2; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatalf("expected the credits to be granted, got: %+v", cc.Stats())
+		}
+	}
+}
+
+func TestFlowDrop(t *testing.T) {
+
+	scon := serverConfig("test_flow_drop")
+	scon.ReceiveBuffer = 1
+	sc, err := StartServer(scon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	Sleep()
+
+	ccon := clientConfig("test_flow_drop")
+	ccon.FlowPolicy = FlowDrop
+	cc, err := StartClient(ccon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	if err = cc.Write(5, []byte("kept")); err != nil {
+		t.Fatal(err)
+	}
+	if err = cc.Write(5, []byte("dropped")); err != ErrDropped {
+		t.Errorf("expected the message to be dropped, got: %v", err)
+	}
+	if dropped := cc.Stats().Dropped; dropped != 1 {
+		t.Errorf("expected 1 dropped message, got %d", dropped)
+	}
+
+	m, err := sc.Read()
+	if err != nil || string(m.Data) != "kept" {
+		t.Errorf("expected the message which was kept, got %v %v", m, err)
+	}
+}
+
+func TestFlowDiscard(t *testing.T) {
+
+	cc, err := NewClient("test_flow_discard", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc.flow = newFlowControl(4, FlowBlock)
+
+	//the messages discarded give back their credits, the fragments of a message but its last and
+	//the control frames and chunks which didn't use one don't
+	cc.discard(&frame{msgType: 5})
+	cc.discard(&frame{msgType: 5, fragment: laneNormal | fragmentMore})
+	cc.discard(&frame{msgType: 5, fragment: laneNormal})
+	cc.discard(&frame{msgType: 5, flags: frameChunk})
+	cc.discard(&frame{flags: frameCredit})
+
+	f := cc.flow.creditFrame()
+	if f == nil || binary.BigEndian.Uint32(f.data) != 2 {
+		t.Errorf("expected 2 credits to be given back, got %v", f)
+	}
+}
+
+func TestFlowPolicies(t *testing.T) {
+
+	fc := newFlowControl(0, FlowDrop)
+	fc.reset(1)
+
+	done := make(chan struct{})
+	if ok, err := fc.acquire(context.Background(), done); !ok || err != nil {
+		t.Fatal("expected a credit to be available")
+	}
+	if ok, err := fc.acquire(context.Background(), done); ok || err != nil || fc.dropped != 1 {
+		t.Error("expected the message to be dropped")
+	}
+
+	fc.policy = FlowBlock
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := fc.acquire(ctx, done); err != context.DeadlineExceeded {
+		t.Errorf("expected the write to block until the context is done, got: %v", err)
+	}
+
+	acquired := make(chan bool)
+	go func() {
+		ok, _ := fc.acquire(context.Background(), done)
+		acquired <- ok
+	}()
+	fc.grant(1)
+	if !<-acquired {
+		t.Error("expected the blocked write to take the credit granted")
+	}
+
+	//no more credits are granted than the window
+	fc.grant(5)
+	if fc.credits != 1 {
+		t.Errorf("expected the credits to be limited to the window, got %d", fc.credits)
+	}
+}
+
+func TestPrioritySchedule(t *testing.T) {
+
+	cc, err := NewClient("test_priority_schedule", &ClientConfig{SendBuffer: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bulk := bytes.Repeat([]byte{'b'}, 3*FRAGMENT_SIZE+10)
+	cc.toWriteLow <- &frame{msgType: 5, data: bulk, priority: PriorityLow}
+	cc.toWrite <- &frame{msgType: 5, data: []byte("normal")}
+	cc.toWriteHigh <- &frame{msgType: 5, data: []byte("high 1"), priority: PriorityHigh}
+	cc.toWriteHigh <- &frame{msgType: 5, data: []byte("high 2"), priority: PriorityHigh}
+
+	lanes := map[byte]*writeLane{
+		laneHigh:   {id: laneHigh, queue: cc.toWriteHigh},
+		laneNormal: {id: laneNormal, queue: cc.toWrite},
+		laneLow:    {id: laneLow, queue: cc.toWriteLow},
+		laneReplay: {id: laneReplay},
+	}
+	turn := 0
+
+	//the bulk message is written in fragments after the messages of the higher priorities
+	for i, want := range []string{"high 1", "normal", "high 2"} {
+		if f, _ := cc.nextFrame(lanes, &turn); string(f.data) != want || f.fragment != 0 || f.seq != uint32(i+1) {
+			t.Fatalf("Got %s (%d), Wanted %s", f.data, f.fragment, want)
+		}
+	}
+
+	var joined []byte
+	for i := 0; i < 4; i++ {
+		f, _ := cc.nextFrame(lanes, &turn)
+		if f.fragment&^fragmentMore != laneLow || (f.fragment&fragmentMore != 0) != (i < 3) {
+			t.Fatalf("unexpected fragment %d: %d", i, f.fragment)
+		}
+		//only the last fragment numbers the message
+		if (i < 3 && f.seq != 0) || (i == 3 && f.seq != 4) {
+			t.Errorf("unexpected seq of fragment %d: %d", i, f.seq)
+		}
+		joined = append(joined, f.data...)
+	}
+	if !bytes.Equal(joined, bulk) {
+		t.Error("expected the fragments to make up the bulk message")
+	}
+}
+
+func TestQueueFor(t *testing.T) {
+
+	cc, err := NewClient("test_queue_for", &ClientConfig{SendBuffer: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the data of the NetConn is bulk data rather than a control frame
+	for _, tt := range []struct {
+		f     *frame
+		queue chan *frame
+	}{
+		{&frame{}, cc.toWriteHigh},
+		{&frame{flags: frameHeartbeat}, cc.toWriteHigh},
+		{&frame{flags: frameCredit}, cc.toWriteHigh},
+		{&frame{flags: frameConn | frameCredit}, cc.toWriteHigh},
+		{&frame{flags: frameConn, data: []byte("data")}, cc.toWrite},
+		{&frame{flags: frameConn | frameStreamEnd}, cc.toWrite},
+		{&frame{msgType: 5, priority: PriorityLow}, cc.toWriteLow},
+	} {
+		if cc.queueFor(tt.f) != tt.queue {
+			t.Errorf("unexpected queue for the frame with flags %d", tt.f.flags)
+		}
+	}
+}
+
+func TestFragmentLimit(t *testing.T) {
+
+	cc, err := NewClient("test_fragment_limit", &ClientConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc.maxMsgSize = 2 * FRAGMENT_SIZE
+
+	//a frame whose fragments exceed the maximum message length, followed by a regular message
+	chunk := make([]byte, FRAGMENT_SIZE)
+	var wire []byte
+	for _, f := range []*frame{
+		{msgType: 5, fragment: laneLow | fragmentMore, data: chunk},
+		{msgType: 5, fragment: laneLow | fragmentMore, data: chunk},
+		{msgType: 5, fragment: laneLow | fragmentMore, data: chunk},
+		{msgType: 5, fragment: laneLow, seq: 1, data: chunk},
+		{msgType: 6, seq: 2, data: []byte("next")},
+	} {
+		b := f.encode()
+		wire = append(wire, intToBytes(len(b))...)
+		wire = append(wire, b...)
+	}
+
+	r := bytes.NewReader(wire)
+	go cc.read(func(a *Actor, buff []byte) bool {
+		_, err := io.ReadFull(r, buff)
+		return err == nil
+	})
+
+	m, err := cc.Read()
+	if err != nil || m.MsgType != 6 || string(m.Data) != "next" {
+		t.Errorf("expected the oversized frame to be discarded, got %v %v", m, err)
+	}
+
+	for e := range cc.Events() {
+		if e.Err != nil {
+			if e.Err.Error() != "fragmented message exceeds maximum message length" {
+				t.Errorf("unexpected error: %s", e.Err)
+			}
+			break
+		}
+	}
+}
+
+func TestWriteWithPriority(t *testing.T) {
+
+	sc, err := StartServer(serverConfig("test_write_priority"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	Sleep()
+
+	cc, err := StartClient(clientConfig("test_write_priority"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	bulk := make([]byte, 2*1024*1024)
+	for i := range bulk {
+		bulk[i] = byte(i)
+	}
+
+	written := make(chan error, 1)
+	go func() {
+		written <- cc.WriteWithPriority(PriorityLow, 5, bulk)
+	}()
+	if err = cc.WriteWithPriority(PriorityHigh, 6, []byte("cancel")); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-written; err != nil {
+		t.Fatal(err)
+	}
+
+	received := map[int][]byte{}
+	for len(received) < 2 {
+		m, err := sc.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		received[m.MsgType] = m.Data
+	}
+
+	if !bytes.Equal(received[5], bulk) || string(received[6]) != "cancel" {
+		t.Error("expected the messages to be received intact")
+	}
+}
+
+func TestCompression(t *testing.T) {
+
+	payload := bytes.Repeat([]byte(`{"name":"value","count":3,"tags":["a","b"]},`), 4096)
+
+	for _, compressor := range []Compressor{GzipCompressor{}, FlateCompressor{Level: 9}} {
+
+		scon := serverConfig("test_compression")
+		scon.Compressor = compressor
+		sc, err := StartServer(scon)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		Sleep()
+
+		ccon := clientConfig("test_compression")
+		ccon.Compressor = compressor
+		cc, err := StartClient(ccon)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !cc.isCompressing() || !sc.isCompressing() {
+			t.Errorf("%s: expected both sides to agree to compress the messages", compressor.Name())
+		}
+
+		f, err := cc.compress(&frame{msgType: 5, data: payload})
+		if err != nil || !f.compressed || len(f.data) >= len(payload) {
+			t.Errorf("%s: expected the payload to be compressed", compressor.Name())
+		}
+		if f, _ = cc.compress(&frame{msgType: 5, data: []byte("small")}); f.compressed {
+			t.Errorf("%s: expected a message below the threshold not to be compressed", compressor.Name())
+		}
+
+		if err = cc.Write(5, payload); err != nil {
+			t.Fatal(err)
+		}
+		m, err := sc.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(m.Data, payload) {
+			t.Errorf("%s: expected the server to receive the payload intact", compressor.Name())
+		}
+
+		if err = sc.Write(6, payload); err != nil {
+			t.Fatal(err)
+		}
+		m, err = cc.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(m.Data, payload) {
+			t.Errorf("%s: expected the client to receive the payload intact", compressor.Name())
+		}
+
+		cc.Close()
+		sc.Close()
+	}
+}
+
+func TestCompressorMismatch(t *testing.T) {
+
+	scon := serverConfig("test_compressor_mismatch")
+	scon.Compressor = GzipCompressor{}
+	sc, err := StartServer(scon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	Sleep()
+
+	ccon := clientConfig("test_compressor_mismatch")
+	ccon.Compressor = FlateCompressor{}
+	cc, err := StartClient(ccon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	//compression is optional, the messages are written uncompressed instead
+	if cc.isCompressing() || sc.isCompressing() {
+		t.Error("expected neither side to compress the messages")
+	}
+
+	payload := bytes.Repeat([]byte("compressible "), 1024)
+	if err = cc.Write(5, payload); err != nil {
+		t.Fatal(err)
+	}
+	m, err := sc.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(m.Data, payload) {
+		t.Error("expected the server to receive the payload intact")
+	}
+}
+
+func TestDecompressLimit(t *testing.T) {
+
+	sc, err := NewServer("test_decompress_limit", &ServerConfig{MaxMsgSize: 1024, Compressor: FlateCompressor{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc.setCompressing(true)
+
+	f, err := sc.compress(&frame{msgType: 5, data: make([]byte, FRAGMENT_SIZE+1)})
+	if err != nil || !f.compressed {
+		t.Fatal("expected the frame to be compressed")
+	}
+
+	if err = sc.decompress(f); err == nil || err.Error() != "decompressed message exceeds maximum message length" {
+		t.Errorf("expected decompressing beyond the maximum message length to fail, got: %v", err)
+	}
+}
+
+func TestPeerInGroup(t *testing.T) {
+
+	peer := &PeerCredentials{GID: 100, Groups: []uint32{27, 999}}
+
+	for gid, want := range map[uint32]bool{100: true, 999: true, 5: false} {
+		if peer.inGroup([]uint32{gid}) != want {
+			t.Errorf("gid %d: Wanted %t", gid, want)
+		}
+	}
+}
+
+func TestPreSharedKey(t *testing.T) {
+
+	scon := serverConfig("test_psk")
+	scon.PreSharedKey = []byte("secret")
+	scon.PreSharedKeys = map[string][]byte{"worker": []byte("worker secret")}
+	sc, err := StartServer(scon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	Sleep()
+
+	//a client with the wrong key is rejected without stopping the server
+	ccon := clientConfig("test_psk")
+	ccon.PreSharedKey = []byte("guess")
+	_, err = StartClient(ccon)
+	if err == nil || err.Error() != "server rejected the pre-shared key" {
+		t.Errorf("expected the client to be rejected, got: %v", err)
+	}
+
+	for {
+		e := <-sc.Events()
+		if e.Err != nil {
+			if !errors.Is(e.Err, ErrUnauthorized) {
+				t.Errorf("expected the server to reject the client, got: %s", e.Err)
+			}
+			break
+		}
+	}
+
+	//nor is a client without a key, or with the key of an unknown id
+	_, err = StartClient(clientConfig("test_psk"))
+	if err == nil || err.Error() != "server requires a pre-shared key" {
+		t.Errorf("expected the client to be rejected, got: %v", err)
+	}
+
+	ccon = clientConfig("test_psk")
+	ccon.PreSharedKey = []byte("secret")
+	ccon.PreSharedKeyId = "unknown"
+	_, err = StartClient(ccon)
+	if err == nil || err.Error() != "server rejected the pre-shared key" {
+		t.Errorf("expected the client to be rejected, got: %v", err)
+	}
+
+	ccon = clientConfig("test_psk")
+	ccon.PreSharedKey = []byte("worker secret")
+	ccon.PreSharedKeyId = "worker"
+	cc, err := StartClient(ccon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	if err = cc.Write(5, []byte("authenticated")); err != nil {
+		t.Fatal(err)
+	}
+	m, err := sc.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(m.Data) != "authenticated" {
+		t.Errorf("Got %s, Wanted authenticated", m.Data)
+	}
+}
+
+func TestPreSharedKeyServerUnauthenticated(t *testing.T) {
+
+	sc, err := StartServer(serverConfig("test_psk_server"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	Sleep()
+
+	//a server which can't prove it has the key isn't trusted by the client
+	ccon := clientConfig("test_psk_server")
+	ccon.PreSharedKey = []byte("secret")
+	_, err = StartClient(ccon)
+	if err == nil || err.Error() != "server tried to connect without a pre-shared key" {
+		t.Errorf("expected the client to refuse the server, got: %v", err)
+	}
+}
+
+func TestPreSharedKeyRequiresEncryption(t *testing.T) {
+
+	scon := serverConfig("test_psk_plaintext")
+	scon.Encryption = false
+	scon.PreSharedKey = []byte("secret")
+	sc, err := StartServer(scon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	Sleep()
+
+	//the proofs aren't sent without a shared secret to bind them to
+	ccon := clientConfig("test_psk_plaintext")
+	ccon.Encryption = false
+	ccon.PreSharedKey = []byte("secret")
+	_, err = StartClient(ccon)
+	if err == nil || err.Error() != "pre-shared keys require encryption or tls" {
+		t.Errorf("expected the client to refuse to authenticate, got: %v", err)
+	}
+
+	for {
+		e := <-sc.Events()
+		if e.Err != nil {
+			if e.Err.Error() != "pre-shared keys require encryption or tls" {
+				t.Errorf("expected the server to refuse to authenticate, got: %s", e.Err)
+			}
+			break
+		}
+	}
+}
+
+func TestPreSharedKeyMixed(t *testing.T) {
+
+	key := []byte("secret")
+	shared := bytes.Repeat([]byte{1}, 32)
+
+	sc, err := NewServer("test_psk_mixed", &ServerConfig{Encryption: true, PreSharedKey: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc, err := NewClient("test_psk_mixed", &ClientConfig{Encryption: true, PreSharedKey: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var unmixed [32]byte
+	copy(unmixed[:], shared)
+	plain, _ := createCipher(unmixed)
+
+	if err = sc.mixPreSharedKey(key, shared); err != nil {
+		t.Fatal(err)
+	}
+	if err = cc.mixPreSharedKey(key, shared); err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted, err := sc.encrypt([]byte("message"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mixed := cc.cipher
+	//the key of the exchange alone doesn't decrypt the messages
+	cc.cipher = plain
+	if _, err = cc.decrypt(encrypted); err == nil {
+		t.Error("expected the pre-shared key to be mixed into the key")
+	}
+	cc.cipher = mixed
+	if decrypted, err := cc.decrypt(encrypted); err != nil || string(decrypted) != "message" {
+		t.Error("expected both sides to derive the same key")
+	}
+}
+
+func TestIdentityKeys(t *testing.T) {
+
+	serverKey, err := GenerateIdentityKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKey, err := GenerateIdentityKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the keys survive being saved and loaded
+	dir := t.TempDir()
+	if err = WriteIdentityKey(filepath.Join(dir, "client.key"), clientKey); err != nil {
+		t.Fatal(err)
+	}
+	if clientKey, err = LoadIdentityKey(filepath.Join(dir, "client.key")); err != nil {
+		t.Fatal(err)
+	}
+	trustStore := filepath.Join(dir, "trusted")
+	if err = WriteTrustedKey(trustStore, "server", &serverKey.PublicKey); err != nil {
+		t.Fatal(err)
+	}
+
+	scon := serverConfig("test_identity")
+	scon.IdentityKey = serverKey
+	scon.TrustedKeys = []*ecdsa.PublicKey{&clientKey.PublicKey}
+	sc, err := StartServer(scon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	Sleep()
+
+	ccon := clientConfig("test_identity")
+	ccon.IdentityKey = clientKey
+	ccon.TrustStore = trustStore
+	cc, err := StartClient(ccon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	if identity := cc.PeerIdentity(); identity == nil || !identity.Trusted || identity.Name != "server" || !identity.Key.Equal(&serverKey.PublicKey) {
+		t.Errorf("unexpected identity of the server: %+v", identity)
+	}
+
+	waitForStatus(&sc.Actor, Connected)
+	if identity := sc.PeerIdentity(); identity == nil || !identity.Trusted || identity.Name != identity.Fingerprint || !identity.Key.Equal(&clientKey.PublicKey) {
+		t.Errorf("unexpected identity of the client: %+v", identity)
+	}
+}
+
+func TestUntrustedServerIdentity(t *testing.T) {
+
+	serverKey, _ := GenerateIdentityKey()
+	pinnedKey, _ := GenerateIdentityKey()
+
+	scon := serverConfig("test_untrusted_server")
+	scon.IdentityKey = serverKey
+	sc, err := StartServer(scon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	Sleep()
+
+	//a server impersonating the pinned one is refused
+	ccon := clientConfig("test_untrusted_server")
+	ccon.TrustedKeys = []*ecdsa.PublicKey{&pinnedKey.PublicKey}
+	_, err = StartClient(ccon)
+	if err == nil || !strings.HasPrefix(err.Error(), "server presented an untrusted identity key") {
+		t.Errorf("expected the client to refuse the server, got: %v", err)
+	}
+
+	for {
+		e := <-sc.Events()
+		if e.Err != nil {
+			if !errors.Is(e.Err, ErrIdentityRejected) {
+				t.Errorf("expected the server to be rejected, got: %s", e.Err)
+			}
+			break
+		}
+	}
+
+	//the server carries on listening for a client which trusts it
+	if sc.getStatus() != Listening {
+		t.Errorf("expected the server to be listening, got: %s", sc.Status())
+	}
+
+	ccon = clientConfig("test_untrusted_server")
+	ccon.TrustedKeys = []*ecdsa.PublicKey{&serverKey.PublicKey}
+	cc, err := StartClient(ccon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	if identity := cc.PeerIdentity(); identity == nil || !identity.Key.Equal(&serverKey.PublicKey) {
+		t.Errorf("expected the identity of the server, got %+v", identity)
+	}
+}
+
+func TestUntrustedClientIdentity(t *testing.T) {
+
+	trustedKey, _ := GenerateIdentityKey()
+	clientKey, _ := GenerateIdentityKey()
+
+	scon := serverConfig("test_untrusted_client")
+	scon.TrustedKeys = []*ecdsa.PublicKey{&trustedKey.PublicKey}
+	sc, err := StartServer(scon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	Sleep()
+
+	for _, key := range []*ecdsa.PrivateKey{clientKey, nil} {
+		ccon := clientConfig("test_untrusted_client")
+		ccon.IdentityKey = key
+		_, err = StartClient(ccon)
+		if err == nil || err.Error() != "server rejected the identity of the client" {
+			t.Errorf("expected the client to be rejected, got: %v", err)
+		}
+
+		for {
+			e := <-sc.Events()
+			if e.Err != nil {
+				if !errors.Is(e.Err, ErrUntrustedIdentity) {
+					t.Errorf("expected the server to reject the client, got: %s", e.Err)
+				}
+				break
+			}
+		}
+	}
+
+	ccon := clientConfig("test_untrusted_client")
+	ccon.IdentityKey = trustedKey
+	cc, err := StartClient(ccon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc.Close()
+}
+
+// testCertificate - a certificate for localhost signed by the CA, or a self signed CA without a parent
+func testCertificate(t *testing.T, name string, parent *tls.Certificate) tls.Certificate {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	signer, signerKey := template, any(key)
+	if parent == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestTLS(t *testing.T) {
+
+	ca := testCertificate(t, "ca", nil)
+	serverCert := testCertificate(t, "server", &ca)
+	clientCert := testCertificate(t, "client", &ca)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+
+	scon := serverConfig("test_tls")
+	scon.TLSConfig = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS13,
+	}
+	sc, err := StartServer(scon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	Sleep()
+
+	//a client which doesn't trust the certificate of the server doesn't connect
+	ccon := clientConfig("test_tls")
+	ccon.TLSConfig = &tls.Config{ServerName: "localhost", Certificates: []tls.Certificate{clientCert}}
+	_, err = StartClient(ccon)
+	if err == nil || !strings.HasPrefix(err.Error(), "tls handshake failed") {
+		t.Errorf("expected the tls handshake to fail, got: %v", err)
+	}
+
+	for {
+		e := <-sc.Events()
+		if e.Err != nil {
+			if !errors.Is(e.Err, ErrTLSHandshake) {
+				t.Errorf("expected the server to fail the tls handshake, got: %s", e.Err)
+			}
+			break
+		}
+	}
+
+	ccon = clientConfig("test_tls")
+	ccon.TLSConfig = &tls.Config{ServerName: "localhost", RootCAs: pool, Certificates: []tls.Certificate{clientCert}}
+	cc, err := StartClient(ccon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	if err = cc.Write(5, []byte("over tls")); err != nil {
+		t.Fatal(err)
+	}
+	m, err := sc.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(m.Data) != "over tls" {
+		t.Errorf("Got %s, Wanted over tls", m.Data)
+	}
+
+	//the built-in encryption isn't used on top of TLS
+	if sc.cipher != nil || cc.cipher != nil {
+		t.Error("expected the built-in encryption to be skipped")
+	}
+
+	if certs := cc.PeerCertificates(); len(certs) == 0 || certs[0].Subject.CommonName != "server" {
+		t.Error("expected the client to have the certificate of the server")
+	}
+	if certs := sc.PeerCertificates(); len(certs) == 0 || certs[0].Subject.CommonName != "client" {
+		t.Error("expected the server to have the certificate of the client")
+	}
+	if state, ok := cc.TLSConnectionState(); !ok || state.Version != tls.VersionTLS13 {
+		t.Error("expected the connection to use TLS 1.3")
+	}
+}
+
+func TestTLSServerName(t *testing.T) {
+
+	config := &tls.Config{}
+	cc, err := NewClient("test_tls_server_name", &ClientConfig{TLSConfig: config})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if name := cc.clientTLSConfig("ipc.example.com:8100").ServerName; name != "ipc.example.com" || config.ServerName != "" {
+		t.Errorf("expected the server name to be taken from the address without changing the config, got: %s", name)
+	}
+}
+
+func TestReplayedFrames(t *testing.T) {
+
+	var shared [32]byte
+	gcm, _ := createCipher(shared)
+
+	sc, err := NewServer("test_replayed_frames", &ServerConfig{Encryption: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc, err := NewClient("test_replayed_frames", &ClientConfig{Encryption: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc.cipher, cc.cipher = gcm, gcm
+
+	//the frames written by the client use other nonces, so a frame can't be reflected back
+	reflected, _ := cc.encrypt([]byte("reflected"))
+	if _, err = cc.decrypt(reflected); err != ErrTamperedFrame {
+		t.Errorf("expected a reflected frame to be rejected, got: %v", err)
+	}
+
+	first, _ := sc.encrypt([]byte("first"))
+	second, _ := sc.encrypt([]byte("second"))
+	third, _ := sc.encrypt([]byte("third"))
+
+	if _, err = cc.decrypt(second); err != ErrReorderedFrame {
+		t.Errorf("expected a frame received out of order to be rejected, got: %v", err)
+	}
+	if m, err := cc.decrypt(first); err != nil || string(m) != "first" {
+		t.Errorf("expected the first frame to be accepted, got: %v", err)
+	}
+	if _, err = cc.decrypt(first); err != ErrReplayedFrame {
+		t.Errorf("expected a replayed frame to be rejected, got: %v", err)
+	}
+
+	//a frame can't be renumbered as the number is the nonce it was encrypted with
+	binary.BigEndian.PutUint64(third, 2)
+	if _, err = cc.decrypt(third); err != ErrTamperedFrame {
+		t.Errorf("expected a renumbered frame to be rejected, got: %v", err)
+	}
+}
+
+func TestReplayedFrameConnection(t *testing.T) {
+
+	sc, err := StartServer(&ServerConfig{Name: "test_replayed_connection", Encryption: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	Sleep()
+
+	cc, err := StartClient(&ClientConfig{Name: "test_replayed_connection", Encryption: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	if err = cc.Write(5, []byte("once")); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := sc.Read(); err != nil || string(m.Data) != "once" {
+		t.Fatal("expected the message to be received")
+	}
+
+	//the first frame the client encrypted was a message of its handshake
+	replayed := make([]byte, 8)
+	binary.BigEndian.PutUint64(replayed, 1)
+	replayed = (*cc.cipher).Seal(replayed, nonce(*cc.cipher, nonceClient, 1), nil, nil)
+	if _, err = cc.getConn().Write(append(intToBytes(len(replayed)), replayed...)); err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		e := <-sc.Events()
+		if e.Err != nil {
+			if e.Err != ErrReplayedFrame {
+				t.Errorf("expected the server to reject the replayed frame, got: %s", e.Err)
+			}
+			break
+		}
+	}
+
+	//the connection carries on as the frame was discarded
+	if err = sc.Write(6, []byte("still connected")); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := cc.Read(); err != nil || string(m.Data) != "still connected" {
+		t.Error("expected the connection to carry on")
+	}
+}
@@ -55,9 +55,9 @@ func TestServerClose(t *testing.T) {
 
 	go func() {
 		for {
-			m, _ := cc.Read()
+			e := <-cc.Events()
 
-			if m.Status == "Reconnecting" {
+			if e.Status == ReConnecting {
 				holdIt <- false
 				return
 			}
@@ -66,14 +66,14 @@ func TestServerClose(t *testing.T) {
 
 	for {
 
-		mm, err2 := sc.Read()
+		e := <-sc.Events()
 
-		if err2 == nil {
-			if mm.Status == "Connected" {
+		if e.Err == nil {
+			if e.Status == Connected {
 				sc.Close()
 			}
 
-			if mm.Status == "Closed" {
+			if e.Status == Closed {
 				break
 			}
 		}
@@ -81,3 +81,69 @@ func TestServerClose(t *testing.T) {
 
 	<-holdIt
 }
+
+func TestTransportsSideBySide(t *testing.T) {
+
+	unixTransport := &UnixTransport{}
+	networkTransport := &NetworkTransport{Port: 8299}
+
+	scon := serverConfig("test_transports")
+	scon.Transport = unixTransport
+	sc, err := StartServer(scon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	scon2 := serverConfig("test_transports")
+	scon2.Transport = networkTransport
+	sc2, err := StartServer(scon2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc2.Close()
+
+	Sleep()
+
+	ccon := clientConfig("test_transports")
+	ccon.Transport = unixTransport
+	cc, err := StartClient(ccon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	ccon2 := clientConfig("test_transports")
+	ccon2.Transport = networkTransport
+	cc2, err := StartClient(ccon2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc2.Close()
+
+	if sc.listener.Addr().Network() != "unix" {
+		t.Errorf("expected a unix listener, got %s", sc.listener.Addr().Network())
+	}
+
+	if sc2.listener.Addr().String() != "127.0.0.1:8299" {
+		t.Errorf("expected a tcp listener on 127.0.0.1:8299, got %s", sc2.listener.Addr())
+	}
+
+	cc.Write(5, []byte("over unix"))
+	cc2.Write(5, []byte("over tcp"))
+
+	for s, want := range map[*Server]string{sc: "over unix", sc2: "over tcp"} {
+		for {
+			m, err := s.Read()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.MsgType == 5 {
+				if string(m.Data) != want {
+					t.Errorf("Got %q, Wanted %q", m.Data, want)
+				}
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package ipc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// netConn - a net.Conn tunnelled over the ipc connection, its data is written as control
+// messages so it doesn't interfere with the messages returned by Read. Like a stream, only
+// STREAM_BUFFER_SIZE frames are written before the other side has read some of them.
+type netConn struct {
+	actor         *Actor
+	data          chan []byte
+	window        *streamWindow
+	overrun       bool
+	current       []byte
+	readDeadline  *connDeadline
+	writeDeadline *connDeadline
+	closed        chan struct{} // closed by Close
+	closeOnce     sync.Once
+	ended         chan struct{} // closed once the other side has closed its net.Conn or the connection was lost
+	endOnce       sync.Once
+	readMutex     sync.Mutex
+	writeMutex    sync.Mutex
+}
+
+func newNetConn(a *Actor) *netConn {
+	return &netConn{
+		actor:         a,
+		data:          make(chan []byte, STREAM_BUFFER_SIZE),
+		window:        newStreamWindow(),
+		readDeadline:  newConnDeadline(),
+		writeDeadline: newConnDeadline(),
+		closed:        make(chan struct{}),
+		ended:         make(chan struct{}),
+	}
+}
+
+// NetConn - returns a net.Conn whose data is tunnelled over the connection, so existing
+// stream protocols can be used over an established (and encrypted) Client or Server.
+// Each connection has a single net.Conn which can't be used again once closed, writes
+// are split into frames no larger than the maximum message size.
+func (a *Actor) NetConn() net.Conn {
+	return a.getTunnel()
+}
+
+// getTunnel - the net.Conn is created on first use, which may be the other side writing to it
+func (a *Actor) getTunnel() *netConn {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.tunnel == nil {
+		a.tunnel = newNetConn(a)
+	}
+	return a.tunnel
+}
+
+// receive - queues the data received for the net.Conn, an empty frame ends it. The data of a
+// closed net.Conn is discarded, as is everything once the other side overruns its window.
+func (c *netConn) receive(f *frame) {
+
+	if f.flags&frameStreamEnd != 0 {
+		c.end()
+		return
+	}
+
+	select {
+	case <-c.closed:
+		return
+	default:
+	}
+
+	if c.overrun {
+		return
+	}
+
+	select {
+	case c.data <- f.data:
+	default:
+		c.overrun = true
+		c.actor.logger.Errorf("%s.NetConn err: %s", c.actor, ErrStreamOverrun)
+		c.actor.dispatchError(ErrStreamOverrun)
+		c.end()
+	}
+}
+
+// grant - returns the credits of the frames the other side has read
+func (c *netConn) grant(credits int) {
+	c.window.grant(credits)
+}
+
+// end - the net.Conn won't receive any more data, nor can it write any more
+func (c *netConn) end() {
+	c.endOnce.Do(func() {
+		close(c.ended)
+		c.window.abort()
+	})
+}
+
+func (c *netConn) Read(p []byte) (int, error) {
+	c.readMutex.Lock()
+	defer c.readMutex.Unlock()
+
+	for len(c.current) == 0 {
+
+		//the data already received is read before the end is returned
+		select {
+		case c.current = <-c.data:
+			c.granted()
+			continue
+		default:
+		}
+
+		select {
+		case <-c.closed:
+			return 0, net.ErrClosed
+		case <-c.readDeadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		case c.current = <-c.data:
+			c.granted()
+		case <-c.ended:
+			select {
+			case c.current = <-c.data:
+				c.granted()
+			default:
+				return 0, io.EOF
+			}
+		}
+	}
+
+	n := copy(p, c.current)
+	c.current = c.current[n:]
+
+	return n, nil
+}
+
+// granted - the frame has left the buffer so the other side can write another
+func (c *netConn) granted() {
+	c.actor.grant(frameConn|frameCredit, 0)
+}
+
+func (c *netConn) Write(p []byte) (int, error) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	case <-c.writeDeadline.wait():
+		return 0, os.ErrDeadlineExceeded
+	default:
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-c.writeDeadline.wait():
+			cancel()
+		case <-c.closed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	//the maximum message size is set by the handshake
+	chunkSize := c.actor.getMaxMsgSize()
+	if chunkSize == 0 && len(p) > 0 {
+		err := errors.New("cannot write to the net.Conn before the connection has been established")
+		c.actor.logger.Errorf("%s.NetConn err: %s", c.actor, err)
+		return 0, err
+	}
+	written := 0
+
+	for len(p) > 0 {
+		n := min(chunkSize, len(p))
+
+		//the frame is written asynchronously so it can't share the caller's buffer
+		data := make([]byte, n)
+		copy(data, p[:n])
+
+		err := c.window.acquire(ctx)
+		if err == io.ErrUnexpectedEOF {
+			return written, io.ErrClosedPipe
+		}
+		if err == nil {
+			err = c.actor.writeFrame(ctx, &frame{flags: frameConn, data: data})
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				select {
+				case <-c.closed:
+					return written, net.ErrClosed
+				default:
+					return written, os.ErrDeadlineExceeded
+				}
+			}
+			return written, err
+		}
+
+		p = p[n:]
+		written += n
+	}
+
+	return written, nil
+}
+
+// Close - closes the net.Conn and tells the other side no more data will be written,
+// the ipc connection remains open
+func (c *netConn) Close() error {
+
+	err := net.ErrClosed
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		err = c.actor.writeFrame(context.Background(), &frame{flags: frameConn | frameStreamEnd})
+	})
+
+	return err
+}
+
+func (c *netConn) LocalAddr() net.Addr {
+	return c.actor.getConn().LocalAddr()
+}
+
+func (c *netConn) RemoteAddr() net.Addr {
+	return c.actor.getConn().RemoteAddr()
+}
+
+func (c *netConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *netConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *netConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// connDeadline - a channel which is closed once the deadline passes, a new channel is
+// used each time the deadline is moved so the operations waiting on it see the change
+type connDeadline struct {
+	mutex   sync.Mutex
+	timer   *time.Timer
+	expired chan struct{}
+}
+
+func newConnDeadline() *connDeadline {
+	return &connDeadline{expired: make(chan struct{})}
+}
+
+func (d *connDeadline) set(t time.Time) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.expired // the timer has fired, wait for it to close the channel
+	}
+	d.timer = nil
+
+	expired := false
+	select {
+	case <-d.expired:
+		expired = true
+	default:
+	}
+
+	if t.IsZero() {
+		if expired {
+			d.expired = make(chan struct{})
+		}
+		return
+	}
+
+	if wait := time.Until(t); wait > 0 {
+		if expired {
+			d.expired = make(chan struct{})
+		}
+		d.timer = time.AfterFunc(wait, func() {
+			close(d.expired)
+		})
+		return
+	}
+
+	if !expired {
+		close(d.expired)
+	}
+}
+
+func (d *connDeadline) wait() chan struct{} {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.expired
+}
@@ -0,0 +1,130 @@
+package ipc
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// BufferPolicy - what a write does when the outbound buffer of a client which is
+// (re)connecting is full
+type BufferPolicy int
+
+const (
+	// BufferBlock - the write waits until the buffer is flushed or its context is done
+	BufferBlock BufferPolicy = iota
+	// BufferDropOldest - the oldest buffered message is discarded to make room
+	BufferDropOldest
+	// BufferDropNewest - the message being written is discarded and an error returned
+	BufferDropNewest
+)
+
+// outbox - holds the messages written while the client is connecting or reconnecting,
+// they are written in order once the handshake of the new connection has completed
+type outbox struct {
+	mutex  sync.Mutex
+	frames []*frame
+	size   int
+	policy BufferPolicy
+	space  chan struct{} // closed and replaced each time frames leave the buffer, to wake blocked writes
+}
+
+func newOutbox(size int, policy BufferPolicy) *outbox {
+	return &outbox{
+		size:   size,
+		policy: policy,
+		space:  make(chan struct{}),
+	}
+}
+
+// queue - buffers the frame while the client isn't connected, returns false when the client
+// is connected and the frame should be written straight away
+func (o *outbox) queue(ctx context.Context, c *Client, f *frame) (bool, error) {
+
+	for {
+		o.mutex.Lock()
+
+		status := c.getStatus()
+		if status != Connecting && status != ReConnecting {
+			o.mutex.Unlock()
+			return false, nil
+		}
+
+		if len(o.frames) < o.size {
+			if err := c.persist(f); err != nil {
+				o.mutex.Unlock()
+				return false, err
+			}
+			o.frames = append(o.frames, f)
+			o.mutex.Unlock()
+			return true, nil
+		}
+
+		switch o.policy {
+		case BufferDropOldest:
+			if err := c.persist(f); err != nil {
+				o.mutex.Unlock()
+				return false, err
+			}
+			c.forget(o.frames[0])
+			o.frames = append(o.frames[1:], f)
+			o.mutex.Unlock()
+			c.logger.Warnf("%s.Write the outbound buffer is full, dropped the oldest message", c)
+			c.dispatchErrorStr("the outbound buffer is full, dropped the oldest message")
+			return true, nil
+		case BufferDropNewest:
+			o.mutex.Unlock()
+			err := errors.New("the outbound buffer is full")
+			c.logger.Errorf("%s.Write err: %s", c, err)
+			return false, err
+		}
+
+		space := o.space
+		o.mutex.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-c.done:
+			err := errors.New("the connection has been closed")
+			c.logger.Errorf("%s.Write err: %s", c, err)
+			return false, err
+		case <-space:
+		}
+	}
+}
+
+// flush - writes the buffered frames in order, using the queue of their Priority and the window
+// of the other side as any other write. The status is only set to Connected once the buffer is
+// empty so the frames aren't overtaken by new writes.
+func (o *outbox) flush(c *Client) {
+
+	for {
+		o.mutex.Lock()
+
+		if len(o.frames) == 0 {
+			c.setStatus(Connected)
+			o.mutex.Unlock()
+			return
+		}
+
+		f := o.frames[0]
+		o.frames[0] = nil
+		o.frames = o.frames[1:]
+		close(o.space)
+		o.space = make(chan struct{})
+
+		o.mutex.Unlock()
+
+		if len(f.data) > c.maxMsgSize {
+			c.logger.Errorf("%s.flush err: buffered message exceeds maximum message length", c)
+			c.dispatchErrorStr("buffered message exceeds maximum message length")
+			c.forget(f)
+			continue
+		}
+
+		if !c.requeue(c.queueFor(f), f) {
+			return
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package ipc
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+)
+
+// PeerCredentials - the process on the other side of a unix socket connection, learned from the
+// socket when the connection is accepted (SO_PEERCRED, only supported on linux)
+type PeerCredentials struct {
+	UID    uint32
+	GID    uint32   // the primary group of the process
+	Groups []uint32 // the supplementary groups of the process when it connected (SO_PEERGROUPS)
+	PID    int
+}
+
+// inGroup - whether the primary group or one of the supplementary groups of the peer is allowed
+func (p *PeerCredentials) inGroup(gids []uint32) bool {
+	if slices.Contains(gids, p.GID) {
+		return true
+	}
+	for _, gid := range p.Groups {
+		if slices.Contains(gids, gid) {
+			return true
+		}
+	}
+	return false
+}
+
+// restrictsPeers - whether the server only accepts the processes allowed by its peer policy
+func (s *Server) restrictsPeers() bool {
+	config := s.config.ServerConfig
+	return len(config.AllowedUIDs) > 0 || len(config.AllowedGIDs) > 0 || config.AuthorizePeer != nil
+}
+
+// checkPeer - learns the credentials of the process which has connected and checks the peer policy
+// allows it, before the handshake has started. A connection without credentials, such as a TCP
+// connection, is only accepted when the server doesn't restrict its peers.
+func (s *Server) checkPeer(conn net.Conn) (*PeerCredentials, error) {
+
+	peer, err := getPeerCredentials(conn)
+	if !s.restrictsPeers() {
+		return peer, nil
+	}
+
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("peer rejected, unable to get its credentials: %s", err))
+	}
+
+	config := s.config.ServerConfig
+
+	//either list allows the peer when both are given
+	if len(config.AllowedUIDs) > 0 || len(config.AllowedGIDs) > 0 {
+		if !slices.Contains(config.AllowedUIDs, peer.UID) && !peer.inGroup(config.AllowedGIDs) {
+			return nil, errors.New(fmt.Sprintf("peer rejected, uid %d gid %d pid %d isn't allowed", peer.UID, peer.GID, peer.PID))
+		}
+	}
+
+	if config.AuthorizePeer != nil {
+		err = config.AuthorizePeer(peer)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("peer rejected, uid %d gid %d pid %d: %s", peer.UID, peer.GID, peer.PID, err))
+		}
+	}
+
+	return peer, nil
+}
+
+// PeerCredentials - the credentials of the connected process, nil when they aren't known such
+// as for TCP connections or on platforms other than linux
+func (s *Server) PeerCredentials() *PeerCredentials {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.peer
+}
+
+func (s *Server) setPeerCredentials(peer *PeerCredentials) {
+	s.mutex.Lock()
+	s.peer = peer
+	s.mutex.Unlock()
+}
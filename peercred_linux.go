@@ -0,0 +1,73 @@
+//go:build linux
+
+package ipc
+
+import (
+	"crypto/tls"
+	"errors"
+	"golang.org/x/sys/unix"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// getPeerCredentials - reads SO_PEERCRED from the socket of a unix connection
+func getPeerCredentials(conn net.Conn) (*PeerCredentials, error) {
+
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, errors.New("peer credentials are only available for unix socket connections")
+	}
+
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var ucred *syscall.Ucred
+	var groups []uint32
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		ucred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+		if credErr == nil {
+			groups, credErr = peerGroups(int(fd))
+		}
+	})
+	if err == nil {
+		err = credErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &PeerCredentials{UID: ucred.Uid, GID: ucred.Gid, Groups: groups, PID: int(ucred.Pid)}, nil
+}
+
+// peerGroups - the supplementary groups of the process captured with its credentials when it
+// connected (SO_PEERGROUPS), SO_PEERCRED only has its primary group. Nil on kernels before 4.13,
+// so only the primary group is matched.
+func peerGroups(fd int) ([]uint32, error) {
+
+	groups := make([]uint32, 64)
+	for {
+		size := uint32(len(groups) * 4)
+		_, _, errno := unix.Syscall6(unix.SYS_GETSOCKOPT, uintptr(fd), unix.SOL_SOCKET, unix.SO_PEERGROUPS,
+			uintptr(unsafe.Pointer(&groups[0])), uintptr(unsafe.Pointer(&size)), 0)
+
+		switch errno {
+		case 0:
+			return groups[:size/4], nil
+		case unix.ERANGE:
+			//the size needed has been set
+			groups = make([]uint32, size/4)
+		case unix.ENOPROTOOPT:
+			return nil, nil
+		default:
+			return nil, errno
+		}
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package ipc
+
+import (
+	"errors"
+	"net"
+)
+
+// getPeerCredentials - SO_PEERCRED is only supported on linux
+func getPeerCredentials(conn net.Conn) (*PeerCredentials, error) {
+	return nil, errors.New("peer credentials are only available on linux")
+}
@@ -0,0 +1,73 @@
+package ipc
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// ReconnectPolicy - how long a client waits between attempts to connect, both when it is
+// started and when it reconnects after losing the connection
+type ReconnectPolicy struct {
+	InitialDelay time.Duration // the delay before the first retry, defaults to the RetryTimer
+	Multiplier   float64       // multiplies the delay after each failed attempt, values below 1 keep it constant
+	MaxDelay     time.Duration // the longest delay between attempts, 0 is unlimited
+	Jitter       float64       // the fraction of the delay which is randomised (0.2 = ±20%) so clients don't retry in lockstep, between 0 and 1
+	MaxAttempts  int           // the attempts to connect before giving up, 0 is unlimited
+	// ShouldReconnect - called before each attempt to connect again with the number of failed attempts
+	// and the last error, which is nil when the connection was lost. Returning false stops the client.
+	ShouldReconnect func(attempt int, err error) bool
+}
+
+// delay - the duration to wait after the number of failed attempts
+func (p *ReconnectPolicy) delay(attempt int) time.Duration {
+
+	delay := float64(p.InitialDelay)
+	if p.Multiplier > 1 && attempt > 1 {
+		delay *= math.Pow(p.Multiplier, float64(attempt-1))
+	}
+
+	if p.MaxDelay > 0 && delay > float64(p.MaxDelay) {
+		delay = float64(p.MaxDelay)
+	}
+
+	if p.Jitter > 0 {
+		delay += delay * p.Jitter * (rand.Float64()*2 - 1)
+	}
+
+	return time.Duration(delay)
+}
+
+// allow - returns an error when the policy doesn't allow another attempt to connect
+func (p *ReconnectPolicy) allow(attempt int, err error) error {
+
+	if p.MaxAttempts > 0 && attempt >= p.MaxAttempts {
+		return errors.New(fmt.Sprintf("gave up connecting after %d attempts", attempt))
+	}
+
+	if p.ShouldReconnect != nil && !p.ShouldReconnect(attempt, err) {
+		return errors.New("connecting again was vetoed by the reconnect policy")
+	}
+
+	return nil
+}
+
+// getReconnectPolicy - the policy of the config, by default the RetryTimer is waited between every attempt
+func getReconnectPolicy(policy *ReconnectPolicy, retryTimer time.Duration) *ReconnectPolicy {
+
+	if policy == nil {
+		return &ReconnectPolicy{InitialDelay: retryTimer}
+	}
+
+	p := *policy
+	if p.InitialDelay <= 0 {
+		p.InitialDelay = retryTimer
+	}
+
+	//a jitter above 1 could make the delay negative
+	p.Jitter = min(max(p.Jitter, 0), 1)
+
+	return &p
+}
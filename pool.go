@@ -1,137 +1,226 @@
 package ipc
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
 	"sync"
 	"time"
 )
 
-var clientIdRequest = &Message{
-	Data:    []byte("client_id_request"),
-	MsgType: CLIENT_CONNECT_MSGTYPE,
-}
-
-func isClientIdRequest(msg *Message) bool {
-	return msg.MsgType == CLIENT_CONNECT_MSGTYPE && string(msg.Data) == string(clientIdRequest.Data)
-}
-
+// StartServerPool - starts a server which accepts many clients on the same listener,
+// each accepted connection is handled by its own Server in the ConnectionPool
 func StartServerPool(config *ServerConfig) (*Server, error) {
 
-	//copy to prevent modification of the reference
-	configName := config.Name
-
-	//creates a server exclusively for listening for new connections
-	cms, err := NewServer(configName+"_manager", config)
-	if err != nil {
-		return nil, err
-	}
-	cms, err = cms.run(0)
+	s, err := newServerPool(config)
 	if err != nil {
 		return nil, err
 	}
 
-	//create another server for the user to interface
-	s, err := NewServer(configName, config)
+	return s.run(context.Background())
+}
+
+func newServerPool(config *ServerConfig) (*Server, error) {
+
+	s, err := NewServer(config.Name, config)
 	if err != nil {
 		return nil, err
 	}
 	s.Connections = &ConnectionPool{
-		Servers:      []*Server{cms, s},
-		ServerConfig: config,
+		Servers:      []*Server{},
+		ServerConfig: s.config.ServerConfig,
 		Logger:       s.logger,
 		mutex:        &sync.Mutex{},
+		server:       s,
+		joined:       make(chan bool, 1),
+		clientIds:    make(map[int]bool),
+		sessions:     make(map[string]*session),
 	}
 
-	go connectionListener(cms, s)
-
-	return s.run(1)
+	return s, nil
 }
 
-func connectionListener(cms *Server, s *Server) {
-	clientCount := 1
+// accept - checks the peer of a newly accepted connection, performs the handshake and adds it
+// to the pool, the connection is rejected when the pool already has MaxClients
+func (sm *ConnectionPool) accept(conn net.Conn) {
 
-	for {
+	peer, err := sm.server.checkPeer(conn)
+	if err != nil {
+		sm.Logger.Errorf("ConnectionPool.accept err: %s", err)
+		sm.server.dispatchError(err)
+		conn.Close()
+		return
+	}
 
-		msg, err := cms.Read()
-		if err != nil {
-			s.logger.Errorf("ConnectionPool.read err: %s", err)
-			s.dispatchError(err)
-			continue
-		}
+	ns := &Server{
+		Actor: NewActor(&ActorConfig{
+			IsServer:     true,
+			ServerConfig: sm.ServerConfig,
+		}),
+		pool: sm,
+		peer: peer,
+	}
+	ns.serverRef = ns
+	ns.transport = sm.server.transport
+	ns.calls = sm.server.calls
+	ns.setConn(conn)
 
-		if isClientIdRequest(msg) {
-			err = cms.Write(CLIENT_CONNECT_MSGTYPE, intToBytes(clientCount))
-			if err != nil {
-				continue
-			}
-			if clientCount == 1 {
-				//we already pre-provisioned the first client
-				clientCount++
-				continue
-			}
-			cms.logger.Infof("received a request to create a new client server %d", clientCount)
-			//ns, err2 := NewServer(fmt.Sprintf("%s%d", s.config.ServerConfig.Name, clientCount), s.config.ServerConfig)
-			ns, err2 := NewServer(s.config.ServerConfig.Name, s.config.ServerConfig)
-			if err2 != nil {
-				cms.logger.Errorf("encountered an error attempting to create a client server %d %s", clientCount, err2)
-				continue
-			}
+	clientId, ok := sm.reserve()
+	if !ok {
+		err := errors.New("client rejected, the maximum number of clients has been reached")
+		sm.Logger.Errorf("ConnectionPool.accept err: %s", err)
+		sm.server.dispatchError(err)
+		ns.withContext(sm.server.ctx, ns.reject)
+		conn.Close()
+		return
+	}
+	ns.ClientId = clientId
 
-			go ns.run(clientCount)
-			clientCount++
-			s.Connections.mutex.Lock()
-			s.Connections.Servers = append(s.Connections.Servers, ns)
-			s.Connections.mutex.Unlock()
-		}
+	err = ns.withContext(sm.server.ctx, ns.handshake)
+	if err != nil {
+		sm.Logger.Errorf("ConnectionPool.accept handshake err: %s", err)
+		sm.server.dispatchError(err)
+		conn.Close()
+		sm.release(clientId, nil)
+		return
 	}
+
+	sm.Logger.Infof("ConnectionPool.accept created a new client server %d", ns.ClientId)
+
+	sm.mutex.Lock()
+	sm.accepting--
+	sm.Servers = append(sm.Servers, ns)
+	sm.mutex.Unlock()
+
+	select {
+	case sm.joined <- true:
+	default:
+	}
+
+	for _, subscriber := range sm.getSubscribers() {
+		subscriber(ns)
+	}
+
+	ns.start(true)
 }
 
-func StartClientPool(config *ClientConfig) (*Client, error) {
+// subscribe - calls the subscriber with each client server added to the pool until unsubscribed
+func (sm *ConnectionPool) subscribe(subscriber func(*Server)) (unsubscribe func()) {
+	sm.mutex.Lock()
+	if sm.subscribers == nil {
+		sm.subscribers = make(map[int]func(*Server))
+	}
+	sm.lastSubId++
+	id := sm.lastSubId
+	sm.subscribers[id] = subscriber
+	sm.mutex.Unlock()
 
-	//copy to prevent modification of the reference
-	configName := config.Name
+	return func() {
+		sm.mutex.Lock()
+		delete(sm.subscribers, id)
+		sm.mutex.Unlock()
+	}
+}
 
-	cm, err := NewClient(configName+"_manager", config)
-	if err != nil {
-		return nil, err
+func (sm *ConnectionPool) getSubscribers() []func(*Server) {
+	sm.mutex.Lock()
+	subscribers := make([]func(*Server), 0, len(sm.subscribers))
+	for _, subscriber := range sm.subscribers {
+		subscribers = append(subscribers, subscriber)
 	}
-	defer cm.Close()
+	sm.mutex.Unlock()
+	return subscribers
+}
 
-	cm, err = start(cm)
-	if err != nil {
-		return nil, err
+// reserve - assigns the lowest ClientId which isn't in use to an accepted connection, unless
+// the pool has reached MaxClients including the connections which are still handshaking
+func (sm *ConnectionPool) reserve() (int, bool) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	maxClients := sm.ServerConfig.MaxClients
+	if maxClients > 0 && len(sm.Servers)+sm.accepting >= maxClients {
+		return 0, false
 	}
 
-	err = cm.WriteMessage(clientIdRequest)
-	if err != nil {
-		return nil, err
+	clientId := 1
+	for sm.clientIds[clientId] {
+		clientId++
 	}
+	sm.clientIds[clientId] = true
+	sm.accepting++
 
-	for {
-		message, err2 := cm.ReadTimed(5 * time.Second)
+	return clientId, true
+}
 
-		if message == TimeoutMessage {
-			continue
-		} else if err2 != nil {
-			cm.logger.Debugf("StartClientPool err: %s", err)
-			continue
-		} else if message.MsgType != CLIENT_CONNECT_MSGTYPE {
-			continue
+// release - frees the ClientId of a connection which failed the handshake, or of the client
+// server which is removed from the pool, for it to be reused
+func (sm *ConnectionPool) release(clientId int, s *Server) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	delete(sm.clientIds, clientId)
+
+	if s == nil {
+		sm.accepting--
+		return
+	}
+
+	servers := make([]*Server, 0, len(sm.Servers))
+	for _, server := range sm.Servers {
+		if server != s {
+			servers = append(servers, server)
 		}
+	}
+	sm.Servers = servers
+}
 
-		clientId := bytesToInt(message.Data)
+// evict - removes a client server whose client has disconnected from the pool, its ClientId
+// is reused by the next client accepted
+func (sm *ConnectionPool) evict(s *Server) {
+	sm.Logger.Infof("ConnectionPool.evict removing client server %d", s.ClientId)
+	s.getConn().Close()
+	sm.release(s.ClientId, s)
+	s.terminate()
+	sm.keepSession(s.session)
+}
 
-		if clientId > 0 {
+// keepSession - holds the session of an evicted client server for SESSION_TIMEOUT, the client
+// resumes it by presenting its token when it reconnects
+func (sm *ConnectionPool) keepSession(s *session) {
 
-			cm.logger.Infof("Attempting to create a new Client %d", clientId)
+	token, _ := s.state()
+	if len(token) == 0 {
+		return
+	}
 
-			cc, err3 := NewClient(configName, config)
-			if err3 != nil {
-				return nil, err3
-			}
-			cc.ClientId = clientId
-			return start(cc)
+	sm.mutex.Lock()
+	sm.sessions[string(token)] = s
+	sm.mutex.Unlock()
+
+	time.AfterFunc(SESSION_TIMEOUT, func() {
+		sm.mutex.Lock()
+		if sm.sessions[string(token)] == s {
+			delete(sm.sessions, string(token))
 		}
+		sm.mutex.Unlock()
+	})
+}
+
+// takeSession - removes the session with the token for the client server resuming it, the session
+// is left for its own client when it was created for another one
+func (sm *ConnectionPool) takeSession(token []byte, owner string) *session {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	s := sm.sessions[string(token)]
+	if s == nil || !s.resumableBy(token, owner) {
+		return nil
 	}
+	delete(sm.sessions, string(token))
+
+	return s
 }
 
 func (sm *ConnectionPool) getServers() []*Server {
@@ -141,22 +230,39 @@ func (sm *ConnectionPool) getServers() []*Server {
 	return servers
 }
 
+// waitForServers - blocks until the pool contains a client server or the duration elapses,
+// a duration of 0 waits indefinitely
+func (sm *ConnectionPool) waitForServers(duration time.Duration) bool {
+
+	if len(sm.getServers()) > 0 {
+		return true
+	}
+
+	if duration == 0 {
+		<-sm.joined
+		return true
+	}
+
+	select {
+	case <-sm.joined:
+		return true
+	case <-time.After(duration):
+		return len(sm.getServers()) > 0
+	}
+}
+
 func (sm *ConnectionPool) MapExec(callback func(*Server), from string) {
 	servers := sm.getServers()
 	serverLen := len(servers)
 	serverOp := make(chan bool, serverLen)
-	for i, server := range servers {
-		//skip the first serverManager instance
-		if i == 0 {
-			continue
-		}
+	for _, server := range servers {
 		go func(s *Server) {
 			callback(s)
 			serverOp <- true
 		}(server)
 	}
 	n := 0
-	for n < serverLen-1 {
+	for n < serverLen {
 		<-serverOp
 		n++
 		sm.Logger.Debugf("sm.%sfinished for server(%d)", from, n)
@@ -164,6 +270,7 @@ func (sm *ConnectionPool) MapExec(callback func(*Server), from string) {
 }
 
 func (sm *ConnectionPool) Read(callback func(*Server, *Message, error)) {
+	sm.waitForServers(0)
 	sm.MapExec(func(s *Server) {
 		message, err := s.Read()
 		callback(s, message, err)
@@ -172,6 +279,9 @@ func (sm *ConnectionPool) Read(callback func(*Server, *Message, error)) {
 
 // ReadTimed will call ReadTimed on all connections waiting for the slowest one to finish
 func (sm *ConnectionPool) ReadTimed(duration time.Duration, callback func(*Server, *Message, error)) {
+	if !sm.waitForServers(duration) {
+		return
+	}
 	sm.MapExec(func(s *Server) {
 		message, err := s.ReadTimed(duration)
 		callback(s, message, err)
@@ -180,6 +290,9 @@ func (sm *ConnectionPool) ReadTimed(duration time.Duration, callback func(*Serve
 
 // ReadTimed will call ReadTimed on all connections waiting for the fastest one to finish
 func (sm *ConnectionPool) ReadTimedFastest(duration time.Duration, callback func(*Server, *Message, error)) {
+	if !sm.waitForServers(duration) {
+		return
+	}
 	wg := make(chan bool, len(sm.getServers()))
 	go func() {
 		sm.MapExec(func(s *Server) {
@@ -191,27 +304,72 @@ func (sm *ConnectionPool) ReadTimedFastest(duration time.Duration, callback func
 	<-wg
 }
 
-func (sm *ConnectionPool) Close() {
-	servers := sm.getServers()
-	serverLen := len(servers)
-	serverOp := make(chan bool, serverLen)
-	var primary *Server
-	for i, server := range servers {
-		//the second server is the one we want to close last
-		if i == 1 {
-			primary = server
-			continue
+// Get - returns the client server with the clientId, nil when it isn't in the pool
+func (sm *ConnectionPool) Get(clientId int) *Server {
+	for _, s := range sm.getServers() {
+		if s.ClientId == clientId {
+			return s
 		}
+	}
+	return nil
+}
+
+// Clients - returns the client servers in the pool which are currently connected
+func (sm *ConnectionPool) Clients() []*Server {
+	var clients []*Server
+	for _, s := range sm.getServers() {
+		if s.getStatus() == Connected {
+			clients = append(clients, s)
+		}
+	}
+	return clients
+}
+
+// SendTo - writes a message to the client with the clientId
+func (sm *ConnectionPool) SendTo(clientId int, msgType int, message []byte) error {
+
+	s := sm.Get(clientId)
+	if s == nil {
+		err := errors.New(fmt.Sprintf("no client with ClientId %d", clientId))
+		sm.Logger.Errorf("ConnectionPool.SendTo err: %s", err)
+		return err
+	}
+
+	return s.Write(msgType, message)
+}
+
+// Broadcast - writes a message to every connected client, skipping the client servers which
+// are disconnected. The errors of the writes which failed are returned by ClientId, the map
+// is empty when the message was written to every client.
+func (sm *ConnectionPool) Broadcast(msgType int, message []byte) map[int]error {
+
+	clients := sm.Clients()
+	errs := make(map[int]error)
+	errMutex := &sync.Mutex{}
+	written := make(chan bool, len(clients))
+
+	for _, client := range clients {
 		go func(s *Server) {
-			s.close()
-			serverOp <- true
-		}(server)
+			err := s.Write(msgType, message)
+			if err != nil {
+				errMutex.Lock()
+				errs[s.ClientId] = err
+				errMutex.Unlock()
+			}
+			written <- true
+		}(client)
 	}
-	n := 0
-	for n < serverLen-1 {
-		<-serverOp
-		n++
-		sm.Logger.Debugf("sm.Close finished for server(%d)", n)
+
+	for range clients {
+		<-written
 	}
-	primary.close()
+
+	return errs
+}
+
+// Close - closes the connection of every client server in the pool
+func (sm *ConnectionPool) Close() {
+	sm.MapExec(func(s *Server) {
+		s.close()
+	}, "Close")
 }
@@ -0,0 +1,268 @@
+package ipc
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// Priority - the queue a message is written from, the queues are written in turn weighted
+// towards the higher priorities so a busy queue doesn't hold up the others
+type Priority int
+
+const (
+	PriorityLow    Priority = -1
+	PriorityNormal Priority = 0 // used by Write
+	PriorityHigh   Priority = 1 // also used for the control messages such as heartbeats
+)
+
+const (
+	laneHigh byte = iota + 1
+	laneNormal
+	laneLow
+	laneReplay // the messages written again to a new connection
+)
+
+// fragmentMore - set on every fragment of a frame but its last one
+const fragmentMore byte = 0x80
+
+// prioritySchedule - the lanes written in turn while more than one has frames waiting
+var prioritySchedule = []byte{laneHigh, laneNormal, laneHigh, laneLow, laneHigh, laneNormal, laneHigh}
+
+// writeLane - the queue of a priority along with the frame being written from it in fragments
+type writeLane struct {
+	id      byte
+	queue   chan *frame
+	current *frame
+	offset  int
+	conn    net.Conn // the connection the fragments of the current frame are written to
+}
+
+// WriteWithPriority - writes a message to the ipc connection from the queue of its priority
+func (a *Actor) WriteWithPriority(priority Priority, msgType int, message []byte) error {
+	return a.WriteContextWithPriority(context.Background(), priority, msgType, message)
+}
+
+// WriteContextWithPriority - writes a message from the queue of its priority, giving up waiting
+// for the connection to be established or the message to be queued when the context is done
+func (a *Actor) WriteContextWithPriority(ctx context.Context, priority Priority, msgType int, message []byte) error {
+
+	if msgType == 0 {
+		err := errors.New("message type 0 is reserved")
+		a.logger.Errorf("%s.Write err: %s", a, err)
+		return err
+	}
+
+	return a.writeFrame(ctx, &frame{msgType: msgType, data: message, priority: priority})
+}
+
+// queueFor - the queue of the frame, control frames are written ahead of the messages. The data
+// of the NetConn is written along with the messages, only the credits it grants are control frames.
+func (a *Actor) queueFor(f *frame) chan *frame {
+
+	if f.msgType == 0 && f.flags&frameConn != 0 && f.flags&frameCredit == 0 {
+		return a.toWrite
+	}
+
+	if f.msgType == 0 || f.priority > PriorityNormal {
+		return a.toWriteHigh
+	} else if f.priority < PriorityNormal {
+		return a.toWriteLow
+	}
+
+	return a.toWrite
+}
+
+// nextFrame - the next frame or fragment to write, once the acknowledgements and credits due have
+// been written the messages being replayed are written, then the lanes are taken in turn following
+// the prioritySchedule. A frame larger than FRAGMENT_SIZE is written in fragments so the frames of
+// the other lanes are written in between. Returns nil once the Actor is done.
+func (a *Actor) nextFrame(lanes map[byte]*writeLane, turn *int) (*frame, *writeLane) {
+
+	for {
+		select {
+		case <-a.done:
+			return nil, nil
+		case <-a.session.ackNeeded:
+			if f := a.ackFrame(); f != nil {
+				return f, nil
+			}
+		case <-a.flow.creditNeeded:
+			if f := a.creditFrame(); f != nil {
+				return f, nil
+			}
+		default:
+		}
+
+		if f, granted := a.nextReplay(lanes[laneReplay]); f != nil {
+			return f, lanes[laneReplay]
+		} else if granted != nil {
+			//the lanes wait as well, so the replayed messages aren't overtaken
+			select {
+			case <-a.done:
+				return nil, nil
+			case <-a.session.ackNeeded:
+				if f := a.ackFrame(); f != nil {
+					return f, nil
+				}
+			case <-a.flow.creditNeeded:
+				if f := a.creditFrame(); f != nil {
+					return f, nil
+				}
+			case <-granted:
+			}
+			continue
+		}
+
+		for i := range prioritySchedule {
+			lane := lanes[prioritySchedule[(*turn+i)%len(prioritySchedule)]]
+
+			if lane.current == nil {
+				select {
+				case lane.current = <-lane.queue:
+					lane.offset = 0
+				default:
+					continue
+				}
+			}
+
+			*turn = (*turn + i + 1) % len(prioritySchedule)
+			if f := a.nextFragment(lane); f != nil {
+				return f, lane
+			}
+		}
+
+		select {
+		case <-a.done:
+			return nil, nil
+		case <-a.session.ackNeeded:
+			if f := a.ackFrame(); f != nil {
+				return f, nil
+			}
+		case <-a.flow.creditNeeded:
+			if f := a.creditFrame(); f != nil {
+				return f, nil
+			}
+		case lanes[laneHigh].current = <-lanes[laneHigh].queue:
+			lanes[laneHigh].offset = 0
+		case lanes[laneNormal].current = <-lanes[laneNormal].queue:
+			lanes[laneNormal].offset = 0
+		case lanes[laneLow].current = <-lanes[laneLow].queue:
+			lanes[laneLow].offset = 0
+		case <-a.session.replayNeeded:
+		}
+	}
+}
+
+// nextReplay - the next fragment of the messages being replayed, which use the window of the other
+// side like any other message. Returns the channel closed once credits are granted when the next
+// message has to wait for one.
+func (a *Actor) nextReplay(lane *writeLane) (*frame, chan struct{}) {
+
+	for {
+		if lane.current == nil {
+			f := a.session.nextReplay()
+			if f == nil {
+				return nil, nil
+			}
+			if f.credited() {
+				if ok, granted := a.flow.tryAcquire(); !ok {
+					return nil, granted
+				}
+			}
+			lane.current = f
+			lane.offset = 0
+		}
+
+		if f := a.nextFragment(lane); f != nil {
+			return f, nil
+		}
+	}
+}
+
+// nextFragment - the current frame of the lane when it is small enough to be written whole,
+// otherwise its next fragment. The message is only numbered by the session once its last
+// fragment is written, so the messages are numbered in the order they are received.
+func (a *Actor) nextFragment(lane *writeLane) *frame {
+
+	f := lane.current
+	conn := a.getConn()
+
+	if lane.offset == 0 {
+		lane.conn = conn
+		if len(f.data) <= FRAGMENT_SIZE {
+			lane.current = nil
+			a.session.send(f)
+			return f
+		}
+	} else if lane.conn != conn {
+		//the other side lost the fragments written to the previous connection
+		a.abandonFragments(lane)
+		return nil
+	}
+
+	end := min(lane.offset+FRAGMENT_SIZE, len(f.data))
+	fragment := &frame{
+		msgType:   f.msgType,
+		flags:     f.flags,
+		requestId: f.requestId,
+		fragment:  lane.id,
+		data:      f.data[lane.offset:end],
+	}
+	lane.offset = end
+
+	if end < len(f.data) {
+		fragment.fragment |= fragmentMore
+		a.session.acknowledge(fragment)
+	} else {
+		lane.current = nil
+		a.session.send(f)
+		fragment.seq = f.seq
+		fragment.ack = f.ack
+	}
+
+	return fragment
+}
+
+// abandonFragments - stops writing the frame of the lane as the connection has been lost, the
+// message is numbered so it is replayed. A message being replayed to the lost connection is
+// only replayed again once the session is resumed, rather than retried straight away.
+func (a *Actor) abandonFragments(lane *writeLane) {
+	if lane == nil || lane.current == nil || lane.offset == 0 {
+		return
+	}
+
+	if lane.id == laneReplay && lane.conn == a.getConn() {
+		a.session.send(lane.current)
+	} else {
+		a.session.abandon(lane.current)
+	}
+	lane.current = nil
+}
+
+// ackFrame - the control frame acknowledging the messages received, unless a frame written since
+// has acknowledged them or the connection is being re-established
+func (a *Actor) ackFrame() *frame {
+
+	if !a.session.pendingAck() || a.getStatus() != Connected {
+		return nil
+	}
+
+	f := &frame{}
+	a.session.send(f)
+	return f
+}
+
+// creditFrame - the control frame granting credits back to the other side
+func (a *Actor) creditFrame() *frame {
+
+	if a.getStatus() != Connected {
+		return nil
+	}
+
+	f := a.flow.creditFrame()
+	if f != nil {
+		a.session.send(f)
+	}
+	return f
+}
@@ -0,0 +1,236 @@
+package ipc
+
+import (
+	"context"
+	"sync"
+)
+
+// HandlerFunc - handles a message read from the Server or Client the Router is serving,
+// the Actor can be used to Write or Reply to the sender
+type HandlerFunc func(a *Actor, m *Message)
+
+// EventHandlerFunc - handles an Event of the Server or Client the Router is serving
+type EventHandlerFunc func(a *Actor, e *Event)
+
+// Router - dispatches the messages read from a Server or Client to the handler
+// registered for their MsgType
+type Router struct {
+	mutex       sync.RWMutex
+	handlers    map[int]HandlerFunc
+	fallback    HandlerFunc
+	status      EventHandlerFunc
+	errors      EventHandlerFunc
+	concurrency int
+}
+
+func NewRouter() *Router {
+	return &Router{
+		handlers:    make(map[int]HandlerFunc),
+		concurrency: 1,
+	}
+}
+
+// Handle - registers the handler for messages of msgType, a nil handler removes the existing one
+func (r *Router) Handle(msgType int, handler HandlerFunc) {
+	r.mutex.Lock()
+	if handler == nil {
+		delete(r.handlers, msgType)
+	} else {
+		r.handlers[msgType] = handler
+	}
+	r.mutex.Unlock()
+}
+
+// HandleFallback - registers the handler for messages of a type without a handler
+func (r *Router) HandleFallback(handler HandlerFunc) {
+	r.mutex.Lock()
+	r.fallback = handler
+	r.mutex.Unlock()
+}
+
+// HandleStatus - registers the handler for the Events dispatched when the status changes
+func (r *Router) HandleStatus(handler EventHandlerFunc) {
+	r.mutex.Lock()
+	r.status = handler
+	r.mutex.Unlock()
+}
+
+// HandleError - registers the handler for the Events dispatched when an error occurs
+func (r *Router) HandleError(handler EventHandlerFunc) {
+	r.mutex.Lock()
+	r.errors = handler
+	r.mutex.Unlock()
+}
+
+// SetConcurrency - the number of handlers allowed to run at the same time for each connection,
+// messages are handled in the order they are received when this is 1 (the default)
+func (r *Router) SetConcurrency(concurrency int) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	r.mutex.Lock()
+	r.concurrency = concurrency
+	r.mutex.Unlock()
+}
+
+func (r *Router) getHandler(m *Message) HandlerFunc {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	if handler, ok := r.handlers[m.MsgType]; ok {
+		return handler
+	}
+
+	return r.fallback
+}
+
+func (r *Router) getEventHandler(e *Event) EventHandlerFunc {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	if e.Err != nil {
+		return r.errors
+	}
+
+	return r.status
+}
+
+func (r *Router) getConcurrency() int {
+	r.mutex.RLock()
+	concurrency := r.concurrency
+	r.mutex.RUnlock()
+	return concurrency
+}
+
+// ServeClient - reads and dispatches the messages received by the client until the context is
+// done or the client is closed
+func (r *Router) ServeClient(ctx context.Context, c *Client) error {
+	return r.serve(ctx, &c.Actor, true)
+}
+
+// ServeServer - reads and dispatches the messages received by the server until the context is
+// done or the server is closed. The messages of every client of a MultiClient server are
+// dispatched, including the clients which connect after serving has started. Their Events are
+// handled once, from the Events of the MultiClient server, so the Actor of an event handler is
+// the MultiClient server and the Event's ClientId identifies the client.
+func (r *Router) ServeServer(ctx context.Context, s *Server) error {
+
+	if s.Connections == nil {
+		return r.serve(ctx, &s.Actor, true)
+	}
+
+	wg := &sync.WaitGroup{}
+	served := make(map[*Server]bool)
+	stopped := false
+	mutex := &sync.Mutex{}
+
+	serveClient := func(ns *Server) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if served[ns] || stopped {
+			return
+		}
+		served[ns] = true
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			//the events of each client are served from the Events of the server accepting them
+			r.serve(ctx, &ns.Actor, false)
+		}()
+	}
+
+	unsubscribe := s.Connections.subscribe(serveClient)
+	defer unsubscribe()
+
+	for _, ns := range s.Connections.getServers() {
+		serveClient(ns)
+	}
+
+	//the Events of the server accepting the connections contain those of every client and the handshake errors
+	err := r.serve(ctx, &s.Actor, true)
+
+	mutex.Lock()
+	stopped = true
+	mutex.Unlock()
+	wg.Wait()
+
+	return err
+}
+
+// serve - dispatches the messages read by the Actor, and its Events unless they are
+// served from elsewhere
+func (r *Router) serve(ctx context.Context, a *Actor, events bool) error {
+
+	concurrency := r.getConcurrency()
+	running := make(chan bool, concurrency)
+	wg := &sync.WaitGroup{}
+	defer wg.Wait()
+
+	if events {
+		eventsCtx, stopEvents := context.WithCancel(ctx)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.serveEvents(eventsCtx, a)
+		}()
+		defer stopEvents()
+	}
+
+	for {
+		m, err := a.ReadContext(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+
+		handler := r.getHandler(m)
+		if handler == nil {
+			a.logger.Debugf("%s.Router discarded message of type %d", a, m.MsgType)
+			continue
+		}
+
+		if concurrency == 1 {
+			handler(a, m)
+			continue
+		}
+
+		running <- true
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-running
+				wg.Done()
+			}()
+			handler(a, m)
+		}()
+	}
+}
+
+// serveEvents - dispatches the Events of the Actor until the context is done, handling the
+// Events which were already dispatched before returning
+func (r *Router) serveEvents(ctx context.Context, a *Actor) {
+
+	handle := func(e *Event) {
+		if handler := r.getEventHandler(e); handler != nil {
+			handler(a, e)
+		}
+	}
+
+	for {
+		select {
+		case e := <-a.Events():
+			handle(e)
+		case <-ctx.Done():
+			for {
+				select {
+				case e := <-a.Events():
+					handle(e)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package ipc
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// CallHandler - returns the response data for a request made with Client.Call,
+// a non-nil error is returned to the caller instead of the response data
+type CallHandler func(request *Message) ([]byte, error)
+
+// callRegistry - the handlers registered by a server and the calls awaiting a response on a client
+type callRegistry struct {
+	mutex    sync.Mutex
+	handlers map[int]CallHandler
+	pending  map[uint32]chan *Message
+	lastId   uint32
+}
+
+func newCallRegistry() *callRegistry {
+	return &callRegistry{
+		handlers: make(map[int]CallHandler),
+		pending:  make(map[uint32]chan *Message),
+	}
+}
+
+func (r *callRegistry) getHandler(msgType int) CallHandler {
+	r.mutex.Lock()
+	handler := r.handlers[msgType]
+	r.mutex.Unlock()
+	return handler
+}
+
+func (r *callRegistry) setHandler(msgType int, handler CallHandler) {
+	r.mutex.Lock()
+	if handler == nil {
+		delete(r.handlers, msgType)
+	} else {
+		r.handlers[msgType] = handler
+	}
+	r.mutex.Unlock()
+}
+
+// register - reserves a request id and the channel its response will be delivered to
+func (r *callRegistry) register() (uint32, chan *Message) {
+	r.mutex.Lock()
+	r.lastId++
+	//0 denotes a message which isn't part of a call
+	if r.lastId == 0 {
+		r.lastId++
+	}
+	id := r.lastId
+	response := make(chan *Message, 1)
+	r.pending[id] = response
+	r.mutex.Unlock()
+	return id, response
+}
+
+func (r *callRegistry) unregister(id uint32) {
+	r.mutex.Lock()
+	delete(r.pending, id)
+	r.mutex.Unlock()
+}
+
+// resolve - delivers the response to the waiting caller, returning false when the call is
+// no longer being waited on
+func (r *callRegistry) resolve(m *Message) bool {
+	r.mutex.Lock()
+	response, ok := r.pending[m.RequestId]
+	delete(r.pending, m.RequestId)
+	r.mutex.Unlock()
+
+	if ok {
+		response <- m
+	}
+
+	return ok
+}
+
+// cancel - fails every call awaiting a response
+func (r *callRegistry) cancel(err error) {
+	r.mutex.Lock()
+	for id, response := range r.pending {
+		response <- &Message{Err: err, RequestId: id, MsgType: -1}
+		delete(r.pending, id)
+	}
+	r.mutex.Unlock()
+}
+
+// HandleCall - registers the handler responding to requests of msgType made with Client.Call.
+// Requests without a registered handler are returned by Read and can be answered with Reply.
+// Providing a nil handler removes the existing one.
+func (s *Server) HandleCall(msgType int, handler CallHandler) {
+	s.calls.setHandler(msgType, handler)
+}
+
+// Call - writes a request and blocks until the server responds or the context is done.
+// Many calls can be awaiting a response at the same time, each response is matched to its
+// request by the RequestId carried in the frame.
+func (c *Client) Call(ctx context.Context, msgType int, data []byte) (*Message, error) {
+
+	if msgType == 0 {
+		err := errors.New("message type 0 is reserved")
+		c.logger.Errorf("%s.Call err: %s", c, err)
+		return nil, err
+	}
+
+	id, response := c.calls.register()
+	defer c.calls.unregister(id)
+
+	err := c.writeFrame(ctx, &frame{msgType: msgType, flags: frameRequest, requestId: id, data: data})
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case m := <-response:
+		if m.Err != nil {
+			return nil, m.Err
+		}
+		return m, nil
+	}
+}
+
+// Reply - responds to a request received with Read which didn't have a CallHandler registered
+func (a *Actor) Reply(request *Message, data []byte) error {
+
+	if request.RequestId == 0 {
+		err := errors.New("message is not a request")
+		a.logger.Errorf("%s.Reply err: %s", a, err)
+		return err
+	}
+
+	return a.writeFrame(context.Background(), &frame{msgType: request.MsgType, flags: frameResponse, requestId: request.RequestId, data: data})
+}
+
+// handleCall - runs the CallHandler and writes its response
+func (a *Actor) handleCall(handler CallHandler, request *frame) {
+
+	response := &frame{msgType: request.msgType, flags: frameResponse, requestId: request.requestId}
+
+	data, err := handler(request.toMessage())
+	if err != nil {
+		response.flags |= frameError
+		response.data = []byte(err.Error())
+	} else {
+		response.data = data
+	}
+
+	err = a.writeFrame(context.Background(), response)
+	if err != nil {
+		a.logger.Errorf("%s.handleCall err: %s", a, err)
+	}
+}
+
+// dispatchFrame - routes a received frame to the caller awaiting it, its CallHandler or Read,
+// returns whether the frame is waiting to be read
+func (a *Actor) dispatchFrame(f *frame) bool {
+
+	if f.flags&(frameChunk|frameStreamEnd) != 0 {
+		a.receiveStream(f)
+		return false
+	}
+
+	if f.flags&frameResponse != 0 {
+		if !a.calls.resolve(f.toMessage()) {
+			a.logger.Debugf("%s.read discarded the response to request %d", a, f.requestId)
+		}
+		return false
+	}
+
+	if f.flags&frameRequest != 0 {
+		if handler := a.calls.getHandler(f.msgType); handler != nil {
+			go a.handleCall(handler, f)
+			return false
+		}
+	}
+
+	a.deliver(f.toMessage())
+	return true
+}
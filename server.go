@@ -1,21 +1,38 @@
 package ipc
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"io"
 )
 
 // StartServer - starts the ipc server.
 func StartServer(config *ServerConfig) (*Server, error) {
+	return StartServerContext(context.Background(), config)
+}
+
+// StartServerContext - starts the ipc server which is closed when the context is done,
+// abandoning any handshake in progress
+func StartServerContext(ctx context.Context, config *ServerConfig) (*Server, error) {
 
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var s *Server
+	var err error
 	if config.MultiClient {
-		return StartServerPool(config)
+		s, err = newServerPool(config)
 	} else {
-		s, err := NewServer(config.Name, config)
-		if err != nil {
-			return nil, err
-		}
-		return s.run(0)
+		s, err = NewServer(config.Name, config)
 	}
+	if err != nil {
+		return nil, err
+	}
+
+	return s.run(ctx)
 }
 
 func NewServer(name string, config *ServerConfig) (*Server, error) {
@@ -28,6 +45,7 @@ func NewServer(name string, config *ServerConfig) (*Server, error) {
 		IsServer:     true,
 		ServerConfig: config,
 	})}
+	s.serverRef = s
 
 	if config == nil {
 		serverConfig := &ServerConfig{
@@ -41,12 +59,39 @@ func NewServer(name string, config *ServerConfig) (*Server, error) {
 			s.config.ServerConfig.MaxMsgSize = MAX_MSG_SIZE
 		}
 	}
+
+	if s.config.ServerConfig.Transport != nil {
+		s.transport = s.config.ServerConfig.Transport
+	} else {
+		s.transport = defaultTransport()
+	}
+
 	return s, err
 }
 
-func (s *Server) run(clientId int) (*Server, error) {
+func (s *Server) listen() error {
+
+	address := s.transport.Address(s.config.ServerConfig.Name)
+
+	listener, err := s.transport.Listen(address, s.config.ServerConfig)
+	if err != nil {
+		return err
+	}
+
+	if s.usesTLS() {
+		listener = tls.NewListener(listener, s.config.ServerConfig.TLSConfig)
+	}
+
+	s.listener = listener
+
+	return nil
+}
+
+func (s *Server) run(ctx context.Context) (*Server, error) {
 
-	err := s.listen(clientId)
+	s.ctx = ctx
+
+	err := s.listen()
 	if err != nil {
 		s.logger.Errorf("Server.run err: %s", err)
 		return s, err
@@ -55,6 +100,8 @@ func (s *Server) run(clientId int) (*Server, error) {
 	go s.acceptLoop()
 	s.setStatus(Listening)
 
+	context.AfterFunc(ctx, s.Close)
+
 	return s, nil
 }
 
@@ -68,13 +115,34 @@ func (s *Server) acceptLoop() {
 			return
 		}
 
+		//the pool checks the peer of each connection concurrently, so a slow AuthorizePeer doesn't hold up the others
+		if s.Connections != nil {
+			go s.Connections.accept(conn)
+			continue
+		}
+
+		peer, err := s.checkPeer(conn)
+		if err != nil {
+			s.logger.Errorf("Server.acceptLoop err: %s", err)
+			s.dispatchError(err)
+			conn.Close()
+			continue
+		}
+
 		status := s.getStatus()
 
 		if status == Listening || status == Disconnected {
 
 			s.setConn(conn)
-			err2 := s.handshake()
-			if err2 != nil {
+			s.setPeerCredentials(peer)
+			err2 := s.withContext(s.ctx, s.handshake)
+			if errors.Is(err2, ErrUnauthorized) || errors.Is(err2, ErrUntrustedIdentity) || errors.Is(err2, ErrIdentityRejected) || errors.Is(err2, ErrTLSHandshake) {
+				//an unauthorized client mustn't stop the server accepting the authorized one
+				s.logger.Errorf("Server.acceptLoop handshake err: %s", err2)
+				s.dispatchError(err2)
+				conn.Close()
+
+			} else if err2 != nil {
 				s.logger.Errorf("Server.acceptLoop handshake err: %s", err2)
 				s.dispatchError(err2)
 				s.setStatus(Error)
@@ -82,30 +150,47 @@ func (s *Server) acceptLoop() {
 				conn.Close()
 
 			} else {
-				go s.read(s.ByteReader)
-				go s.write()
-
-				s.dispatchStatus(Connected)
+				s.start(status == Listening)
 			}
 		}
 	}
 }
 
+// start - begins reading and writing once the handshake has completed, the messages of a
+// resumed session which the client hasn't received are written again first. The writer is
+// only started for the first connection as it writes to whichever connection is current.
+func (s *Server) start(first bool) {
+	go s.read(s.ByteReader)
+	if first {
+		go s.write()
+	}
+
+	s.replay()
+	s.dispatchStatus(Connected)
+}
+
 func (s *Server) ByteReader(a *Actor, buff []byte) bool {
 
 	_, err := io.ReadFull(a.conn, buff)
 	if err != nil {
 
 		if a.getStatus() == Closing {
-			a.dispatchStatusBlocking(Closed)
-			a.dispatchErrorStrBlocking("server has closed the connection")
+			a.dispatchStatus(Closed)
+			a.dispatchErrorStr("server has closed the connection")
+			a.terminate()
 			return false
 		}
 
-		if err == io.EOF {
+		a.logger.Debugf("%s.ByteReader err: %s", s, err)
+		if a.connectionEnded(err) {
 			a.dispatchStatus(Disconnected)
-			return false
+			if s.pool != nil {
+				s.pool.evict(s)
+			}
 		}
+
+		// other read error
+		return false
 	}
 
 	return true
@@ -118,14 +203,28 @@ func (s *Server) close() {
 	if s.listener != nil {
 		s.listener.Close()
 	}
+
+	//the reader terminates a connected server, a MultiClient server or one which was never connected has no reader
+	if s.Connections != nil || s.getConn() == nil {
+		s.dispatchStatus(Closed)
+		s.terminate()
+	}
 }
 
 // Close - closes the connection
 func (s *Server) Close() {
 
-	if s.config.ServerConfig.MultiClient {
+	if s.Connections != nil {
 		s.Connections.Close()
+	}
+
+	s.close()
+}
+
+func (s *Server) String() string {
+	if s.ClientId > 0 {
+		return fmt.Sprintf("Server(%d)(%s)", s.ClientId, s.getStatus())
 	} else {
-		s.close()
+		return fmt.Sprintf("Server(%s)", s.getStatus())
 	}
 }
@@ -0,0 +1,271 @@
+package ipc
+
+import (
+	"bytes"
+	"crypto/rand"
+	"sync"
+)
+
+// session - numbers the messages written to the other side and remembers those it hasn't
+// acknowledged yet, so they can be replayed when a reconnecting client resumes the session
+type session struct {
+	mutex        sync.Mutex
+	token        []byte        // identifies the session, assigned by the server during the handshake
+	owner        string        // the client the server created the session for, only it may resume the session
+	sent         uint32        // the seq of the last message sent
+	written      uint32        // the seq of the last message written to the current connection, those after it are replayed
+	received     uint32        // the seq of the last message received
+	acked        uint32        // the last received seq acknowledged to the other side
+	unacked      []*frame      // the messages sent which the other side hasn't acknowledged
+	ackNeeded    chan struct{} // signals the writer to acknowledge the messages received
+	replayNeeded chan struct{} // signals the writer to replay the messages which haven't been written to the connection
+}
+
+func newSession() *session {
+	return &session{ackNeeded: make(chan struct{}, 1), replayNeeded: make(chan struct{}, 1)}
+}
+
+func newSessionToken() ([]byte, error) {
+	token := make([]byte, 16)
+	_, err := rand.Read(token)
+	return token, err
+}
+
+// state - the token of the session and the seq of the last message received
+func (s *session) state() ([]byte, uint32) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.token, s.received
+}
+
+// setOwner - records the client the session was created for
+func (s *session) setOwner(owner string) {
+	s.mutex.Lock()
+	s.owner = owner
+	s.mutex.Unlock()
+}
+
+// resumableBy - whether the session has the token and was created for the client
+func (s *session) resumableBy(token []byte, owner string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(token) > 0 && bytes.Equal(token, s.token) && owner == s.owner
+}
+
+// send - numbers the message the first time it is sent, every frame acknowledges the messages received
+func (s *session) send(f *frame) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.number(f)
+	s.written = max(s.written, f.seq)
+
+	f.ack = s.received
+	s.acked = s.received
+}
+
+// abandon - numbers a message which couldn't be written whole, so it is replayed
+func (s *session) abandon(f *frame) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.number(f)
+}
+
+func (s *session) number(f *frame) {
+	if f.seq == 0 && f.sequenced() {
+		s.sent++
+		f.seq = s.sent
+		s.unacked = append(s.unacked, f)
+	}
+}
+
+// nextReplay - the first message which hasn't been acknowledged nor written to the current connection
+func (s *session) nextReplay() *frame {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, f := range s.unacked {
+		if f.seq > s.written {
+			return f
+		}
+	}
+	return nil
+}
+
+// rewind - the messages which haven't been acknowledged are written to the new connection again
+func (s *session) rewind() {
+	s.mutex.Lock()
+	s.written = 0
+	s.mutex.Unlock()
+}
+
+// acknowledge - acknowledges the messages received with a frame which isn't numbered
+func (s *session) acknowledge(f *frame) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	f.ack = s.received
+	s.acked = s.received
+}
+
+// acknowledged - discards the messages the other side has received, returning the DurableOutbox
+// id of the last one which was persisted
+func (s *session) acknowledged(ack uint32) uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var outboxId uint64
+	n := 0
+	for n < len(s.unacked) && s.unacked[n].seq <= ack {
+		outboxId = max(outboxId, s.unacked[n].outboxId)
+		s.unacked[n] = nil
+		n++
+	}
+	s.unacked = s.unacked[n:]
+
+	return outboxId
+}
+
+// duplicate - whether the message was received before the connection was lost and has been replayed
+func (s *session) duplicate(f *frame) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return f.seq != 0 && f.seq <= s.received
+}
+
+// delivered - records the message has been received and signals the writer to acknowledge it,
+// unless the next frame it writes does so first
+func (s *session) delivered(f *frame) {
+	if f.seq == 0 {
+		return
+	}
+
+	s.mutex.Lock()
+	s.received = f.seq
+	s.mutex.Unlock()
+
+	select {
+	case s.ackNeeded <- struct{}{}:
+	default:
+	}
+}
+
+// pendingAck - whether messages have been received which haven't been acknowledged
+func (s *session) pendingAck() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.received != s.acked
+}
+
+// pending - the messages which haven't been acknowledged, in the order they were sent
+func (s *session) pending() []*frame {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]*frame(nil), s.unacked...)
+}
+
+// reset - starts a new session, returning the number of unacknowledged messages discarded
+func (s *session) reset(token []byte) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	lost := len(s.unacked)
+	s.token = token
+	s.sent = 0
+	s.written = 0
+	s.received = 0
+	s.acked = 0
+	s.unacked = nil
+
+	return lost
+}
+
+// restore - numbers the messages persisted by the DurableOutbox as the first of a new session
+func (s *session) restore(frames []*frame) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, f := range frames {
+		s.sent++
+		f.seq = s.sent
+		s.unacked = append(s.unacked, f)
+	}
+}
+
+// acknowledged - discards the messages the other side has received, those persisted by the
+// DurableOutbox of a client are removed from it too
+func (a *Actor) acknowledged(ack uint32) {
+
+	outboxId := a.session.acknowledged(ack)
+	if outboxId == 0 || a.config.IsServer || a.clientRef.durable == nil {
+		return
+	}
+
+	if err := a.clientRef.durable.ack(outboxId); err != nil {
+		a.logger.Errorf("%s.acknowledged err: %s", a, err)
+		a.dispatchError(err)
+	}
+}
+
+// persist - appends a message written by a client with a DurableOutbox to it before it is sent
+func (a *Actor) persist(f *frame) error {
+
+	if a.config.IsServer || a.clientRef.durable == nil || !f.sequenced() || f.outboxId != 0 {
+		return nil
+	}
+
+	err := a.clientRef.durable.append(f)
+	if err != nil {
+		a.logger.Errorf("%s.Write err: %s", a, err)
+	}
+
+	return err
+}
+
+// forget - removes a message which was discarded before it was sent from the DurableOutbox of
+// a client, as the caller has been told it was dropped
+func (a *Actor) forget(f *frame) {
+
+	if a.config.IsServer || a.clientRef.durable == nil || f.outboxId == 0 {
+		return
+	}
+
+	if err := a.clientRef.durable.drop(f.outboxId); err != nil {
+		a.logger.Errorf("%s.forget err: %s", a, err)
+		a.dispatchError(err)
+	}
+}
+
+// resumeSession - once the handshake has agreed whether the session is resumed, either discards
+// the messages the other side has received, leaving the rest to be replayed, or starts a new session
+func (a *Actor) resumeSession(resumed bool, token []byte, received uint32) {
+
+	if resumed {
+		a.acknowledged(received)
+		a.session.rewind()
+		return
+	}
+
+	lost := a.session.reset(token)
+
+	//the messages of the lost session are written again, along with those persisted before a crash
+	if !a.config.IsServer && a.clientRef.durable != nil {
+		a.session.restore(a.clientRef.durable.frames())
+		return
+	}
+
+	if lost > 0 {
+		a.logger.Warnf("%s.resumeSession the session wasn't resumed, %d unacknowledged messages were lost", a, lost)
+		a.dispatchErrorStr("the session couldn't be resumed, unacknowledged messages were lost")
+	}
+}
+
+// replay - wakes the writer to write the messages the other side hasn't acknowledged again. They
+// keep their numbers, so they are written in order ahead of the priority queues, as the other side
+// would discard them as duplicates once a message with a higher number had overtaken them.
+func (a *Actor) replay() {
+	select {
+	case a.session.replayNeeded <- struct{}{}:
+	default:
+	}
+}
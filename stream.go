@@ -0,0 +1,415 @@
+package ipc
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"io"
+	"sync"
+)
+
+// ErrStreamOverrun - a stream was aborted because the other side wrote more chunks than the reader had room for
+var ErrStreamOverrun = errors.New("the stream was written faster than it was granted")
+
+// streamEndLen - the length of the stream (8 bytes) followed by its sha256 checksum (32 bytes)
+const streamEndLen = 8 + sha256.Size
+
+// StreamWriter - splits everything written to it into chunks no larger than the maximum
+// message size, each chunk is written as soon as it is full so the transfer is never held
+// in memory as a whole. Close must be called to complete the transfer.
+type StreamWriter struct {
+	actor   *Actor
+	msgType int
+	id      uint32
+	window  *streamWindow
+	chunk   []byte
+	hash    hash.Hash
+	length  uint64
+	err     error
+	mutex   sync.Mutex
+}
+
+// StreamReader - reads the chunks of a stream as they are received, returning io.EOF once
+// the whole stream has been read and its length and checksum have been verified
+type StreamReader struct {
+	actor     *Actor
+	id        uint32
+	chunks    chan *streamChunk
+	aborted   chan struct{} // closed when the connection is lost before the end of the stream
+	abortOnce sync.Once
+	abortErr  error
+	overrun   bool // the other side wrote more chunks than it was granted, the rest are discarded
+	current   []byte
+	hash      hash.Hash
+	length    uint64
+	err       error
+}
+
+// streamChunk - the data of a chunk, or the end of the stream when end is set
+type streamChunk struct {
+	data []byte
+	end  bool
+	err  error
+}
+
+// streamWindow - the chunks which can be written before the other side has read some of them,
+// each chunk read grants one back so a reader which falls behind holds up its writer rather
+// than the connection
+type streamWindow struct {
+	credits   chan struct{}
+	aborted   chan struct{} // closed when the connection is lost
+	abortOnce sync.Once
+}
+
+func newStreamWindow() *streamWindow {
+	w := &streamWindow{
+		credits: make(chan struct{}, STREAM_BUFFER_SIZE),
+		aborted: make(chan struct{}),
+	}
+	for i := 0; i < STREAM_BUFFER_SIZE; i++ {
+		w.credits <- struct{}{}
+	}
+	return w
+}
+
+// acquire - waits until the other side has room for another chunk
+func (w *streamWindow) acquire(ctx context.Context) error {
+	select {
+	case <-w.credits:
+		return nil
+	case <-w.aborted:
+		return io.ErrUnexpectedEOF
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// grant - returns the credits of the chunks the other side has read
+func (w *streamWindow) grant(credits int) {
+	for i := 0; i < credits; i++ {
+		select {
+		case w.credits <- struct{}{}:
+		default:
+			return
+		}
+	}
+}
+
+func (w *streamWindow) abort() {
+	w.abortOnce.Do(func() {
+		close(w.aborted)
+	})
+}
+
+// streamRegistry - the streams opened by the Actor and those being received from the other side
+type streamRegistry struct {
+	mutex     sync.Mutex
+	sending   map[uint32]*streamWindow
+	receiving map[uint32]*StreamReader
+	lastId    uint32
+}
+
+func newStreamRegistry() *streamRegistry {
+	return &streamRegistry{sending: make(map[uint32]*streamWindow), receiving: make(map[uint32]*StreamReader)}
+}
+
+func (r *streamRegistry) nextId() uint32 {
+	r.mutex.Lock()
+	r.lastId++
+	//0 denotes a message which isn't part of a stream
+	if r.lastId == 0 {
+		r.lastId++
+	}
+	id := r.lastId
+	r.mutex.Unlock()
+	return id
+}
+
+// open - registers the window of a stream being written
+func (r *streamRegistry) open() (uint32, *streamWindow) {
+	id := r.nextId()
+	window := newStreamWindow()
+
+	r.mutex.Lock()
+	r.sending[id] = window
+	r.mutex.Unlock()
+
+	return id, window
+}
+
+func (r *streamRegistry) closed(id uint32) {
+	r.mutex.Lock()
+	delete(r.sending, id)
+	r.mutex.Unlock()
+}
+
+// grant - returns credits to the writer of a stream
+func (r *streamRegistry) grant(id uint32, credits int) {
+	r.mutex.Lock()
+	window := r.sending[id]
+	r.mutex.Unlock()
+
+	if window != nil {
+		window.grant(credits)
+	}
+}
+
+// abort - fails every stream being written or received
+func (r *streamRegistry) abort(err error) {
+	r.mutex.Lock()
+	for id, window := range r.sending {
+		window.abort()
+		delete(r.sending, id)
+	}
+	for id, reader := range r.receiving {
+		reader.abort(err)
+		delete(r.receiving, id)
+	}
+	r.mutex.Unlock()
+}
+
+// OpenStream - starts a transfer of any length written as a stream of msgType. The other side
+// receives a Message with its Stream set as soon as the first chunk arrives.
+func (a *Actor) OpenStream(msgType int) (*StreamWriter, error) {
+
+	if msgType == 0 {
+		err := errors.New("message type 0 is reserved")
+		a.logger.Errorf("%s.OpenStream err: %s", a, err)
+		return nil, err
+	}
+
+	id, window := a.streams.open()
+
+	return &StreamWriter{
+		actor:   a,
+		msgType: msgType,
+		id:      id,
+		window:  window,
+		hash:    sha256.New(),
+	}, nil
+}
+
+// Write - writes a chunk each time the maximum message size has been buffered
+func (w *StreamWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	//the maximum message size is set by the handshake
+	chunkSize := w.actor.getMaxMsgSize()
+	if chunkSize == 0 && len(p) > 0 {
+		err := errors.New("cannot write to the stream before the connection has been established")
+		w.actor.logger.Errorf("%s.StreamWriter.Write err: %s", w.actor, err)
+		return 0, err
+	}
+	written := 0
+
+	for len(p) > 0 {
+		n := min(chunkSize-len(w.chunk), len(p))
+		w.chunk = append(w.chunk, p[:n]...)
+		p = p[n:]
+		written += n
+
+		if len(w.chunk) == chunkSize {
+			if err := w.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+
+	return written, nil
+}
+
+// flush - writes the buffered chunk once the other side has room for it, a new buffer is
+// used for the next chunk as the frame is written asynchronously
+func (w *StreamWriter) flush() error {
+
+	if len(w.chunk) == 0 {
+		return nil
+	}
+
+	err := w.window.acquire(context.Background())
+	if err != nil {
+		w.err = err
+		return err
+	}
+
+	w.hash.Write(w.chunk)
+	w.length += uint64(len(w.chunk))
+
+	err = w.actor.writeFrame(context.Background(), &frame{msgType: w.msgType, flags: frameChunk, requestId: w.id, data: w.chunk})
+	w.chunk = nil
+	if err != nil {
+		w.err = err
+	}
+
+	return err
+}
+
+// Close - writes the remaining data followed by the length and checksum of the stream
+func (w *StreamWriter) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.err != nil {
+		return w.err
+	}
+
+	if err := w.flush(); err != nil {
+		return err
+	}
+
+	end := make([]byte, 8, streamEndLen)
+	binary.BigEndian.PutUint64(end, w.length)
+	end = w.hash.Sum(end)
+
+	w.err = errors.New("the stream has been closed")
+	w.actor.streams.closed(w.id)
+
+	return w.actor.writeFrame(context.Background(), &frame{msgType: w.msgType, flags: frameStreamEnd, requestId: w.id, data: end})
+}
+
+// CloseWithError - abandons the stream, the reader of the stream returns the error
+func (w *StreamWriter) CloseWithError(err error) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.err != nil {
+		return w.err
+	}
+
+	w.err = errors.New("the stream has been closed")
+	w.actor.streams.closed(w.id)
+
+	return w.actor.writeFrame(context.Background(), &frame{msgType: w.msgType, flags: frameStreamEnd | frameError, requestId: w.id, data: []byte(err.Error())})
+}
+
+// receiveStream - passes a chunk to the reader of its stream, a Message is dispatched for
+// the first frame of a stream. The writer only sends the chunks it has been granted so the
+// connection never waits for the reader, a stream which overruns its window is aborted.
+func (a *Actor) receiveStream(f *frame) {
+
+	a.streams.mutex.Lock()
+	reader, ok := a.streams.receiving[f.requestId]
+	if !ok {
+		reader = &StreamReader{
+			actor: a,
+			id:    f.requestId,
+			//one more than the window so the end of the stream always fits
+			chunks:  make(chan *streamChunk, STREAM_BUFFER_SIZE+1),
+			aborted: make(chan struct{}),
+			hash:    sha256.New(),
+		}
+		a.streams.receiving[f.requestId] = reader
+	}
+	if f.flags&frameStreamEnd != 0 {
+		delete(a.streams.receiving, f.requestId)
+	}
+	a.streams.mutex.Unlock()
+
+	if !ok {
+		a.deliver(&Message{MsgType: f.msgType, Stream: reader})
+	}
+
+	chunk := &streamChunk{data: f.data}
+	if f.flags&frameStreamEnd != 0 {
+		chunk.end = true
+		if f.flags&frameError != 0 {
+			chunk.err = errors.New(string(f.data))
+		}
+	}
+
+	if reader.overrun {
+		return
+	}
+
+	select {
+	case reader.chunks <- chunk:
+	default:
+		reader.overrun = true
+		reader.abort(ErrStreamOverrun)
+		a.logger.Errorf("%s.receiveStream err: %s", a, ErrStreamOverrun)
+		a.dispatchError(ErrStreamOverrun)
+	}
+}
+
+// grant - returns the credit of a chunk read to the writer of a stream or net.Conn, there is
+// nothing to return once the connection has been lost as the writer has been failed
+func (a *Actor) grant(flags byte, id uint32) {
+
+	if a.getStatus() != Connected {
+		return
+	}
+
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, 1)
+	a.writeFrame(context.Background(), &frame{flags: flags, requestId: id, data: data})
+}
+
+// abort - fails the stream, the data already received is discarded
+func (r *StreamReader) abort(err error) {
+	r.abortOnce.Do(func() {
+		r.abortErr = err
+		close(r.aborted)
+	})
+}
+
+// Read - reads the data of the stream as its chunks are received
+func (r *StreamReader) Read(p []byte) (int, error) {
+
+	for len(r.current) == 0 {
+
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		var chunk *streamChunk
+		select {
+		case chunk = <-r.chunks:
+		case <-r.aborted:
+			r.err = r.abortErr
+			continue
+		}
+
+		if chunk.end {
+			r.err = r.verify(chunk)
+			continue
+		}
+
+		r.hash.Write(chunk.data)
+		r.length += uint64(len(chunk.data))
+		r.current = chunk.data
+
+		//the chunk has left the buffer so the writer can send another
+		r.actor.grant(frameCredit|frameChunk, r.id)
+	}
+
+	n := copy(p, r.current)
+	r.current = r.current[n:]
+
+	return n, nil
+}
+
+// verify - checks the length and checksum sent at the end of the stream match the data received
+func (r *StreamReader) verify(end *streamChunk) error {
+
+	if end.err != nil {
+		return end.err
+	}
+
+	if len(end.data) != streamEndLen {
+		return errors.New("received an invalid end of stream")
+	}
+
+	if binary.BigEndian.Uint64(end.data) != r.length || !bytes.Equal(end.data[8:], r.hash.Sum(nil)) {
+		return errors.New("stream integrity check failed")
+	}
+
+	return io.EOF
+}
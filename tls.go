@@ -0,0 +1,106 @@
+package ipc
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// ErrTLSHandshake - dispatched by the server when the TLS handshake with a client fails, such as
+// when it doesn't present a trusted certificate, the server carries on listening
+var ErrTLSHandshake = errors.New("the tls handshake with the client failed")
+
+// tlsExporterLabel - the label of the keying material the pre-shared key and identity proofs are bound to
+const tlsExporterLabel = "EXPORTER-golang-ipc"
+
+// tlsConfig - the TLS config of this side, nil when TLS isn't used
+func (a *Actor) tlsConfig() *tls.Config {
+	if a.config.IsServer {
+		return a.config.ServerConfig.TLSConfig
+	}
+	return a.config.ClientConfig.TLSConfig
+}
+
+func (a *Actor) usesTLS() bool {
+	return a.tlsConfig() != nil
+}
+
+// clientTLSConfig - the TLS config of the client, the server name is taken from the address
+// when it isn't set, as tls.Dial does
+func (c *Client) clientTLSConfig(address string) *tls.Config {
+
+	config := c.config.ClientConfig.TLSConfig
+	if config.ServerName != "" || config.InsecureSkipVerify {
+		return config
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return config
+	}
+
+	config = config.Clone()
+	config.ServerName = host
+
+	return config
+}
+
+// startTLS - completes the TLS handshake before the handshake of the connection, returning the
+// keying material exported from the TLS session for the proofs of the handshake to be bound to
+func (a *Actor) startTLS() ([32]byte, error) {
+
+	var shared [32]byte
+
+	conn, ok := a.getConn().(*tls.Conn)
+	if !ok {
+		return shared, errors.New("the connection doesn't use tls")
+	}
+
+	err := conn.Handshake()
+	if err != nil {
+		if a.config.IsServer {
+			a.logger.Errorf("%s.startTLS err: %s", a, err)
+			return shared, ErrTLSHandshake
+		}
+		return shared, errors.New(fmt.Sprintf("tls handshake failed: %s", err))
+	}
+
+	state := conn.ConnectionState()
+	material, err := state.ExportKeyingMaterial(tlsExporterLabel, nil, len(shared))
+	if err != nil {
+		return shared, err
+	}
+	copy(shared[:], material)
+
+	a.mutex.Lock()
+	a.tlsState = &state
+	a.mutex.Unlock()
+
+	return shared, nil
+}
+
+// PeerCertificates - the certificate chain presented by the other side during the TLS handshake,
+// the first certificate is the certificate of the peer. Nil when TLS isn't used or the peer
+// didn't present a certificate.
+func (a *Actor) PeerCertificates() []*x509.Certificate {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.tlsState == nil {
+		return nil
+	}
+	return a.tlsState.PeerCertificates
+}
+
+// TLSConnectionState - the state of the TLS session of the connection, false when TLS isn't used
+func (a *Actor) TLSConnectionState() (tls.ConnectionState, bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.tlsState == nil {
+		return tls.ConnectionState{}, false
+	}
+	return *a.tlsState, true
+}
@@ -0,0 +1,28 @@
+package ipc
+
+import (
+	"context"
+	"net"
+	"strings"
+)
+
+// Transport - creates the listeners and connections used by a Server and Client.
+// Unix sockets (named pipes on Windows) and TCP are provided, a Transport can be
+// selected per ServerConfig and ClientConfig allowing both to be used by the same process.
+type Transport interface {
+	// Address - returns the address of the named connection
+	Address(name string) string
+	// Listen - creates a listener bound to the address
+	Listen(address string, config *ServerConfig) (net.Listener, error)
+	// Dial - connects to the listener bound to the address, abandoning the attempt when the context is done
+	Dial(ctx context.Context, address string) (net.Conn, error)
+}
+
+// isTransientDialError - errors which happen a lot when a client is waiting for the server
+// to start listening or the connection closes under normal circumstances
+func isTransientDialError(err error) bool {
+	str := err.Error()
+	return strings.Contains(str, "connect: no such file or directory") ||
+		strings.Contains(str, "connect: connection refused") ||
+		strings.Contains(str, "the system cannot find the file specified.")
+}
@@ -0,0 +1,71 @@
+package ipc
+
+import (
+	"errors"
+	"fmt"
+)
+
+// TypedClient - wraps a Client to send requests of type Req and receive responses of type Resp,
+// the values are marshalled with the Codec of the connection
+type TypedClient[Req, Resp any] struct {
+	*Client
+	MsgType int // the MsgType the values are written with, defaults to TYPED_MSG_TYPE
+}
+
+// TypedServer - wraps a Server to receive requests of type Req and send responses of type Resp.
+// The Server must be connected to a single client, the Connections of a MultiClient server can
+// each be wrapped instead.
+type TypedServer[Req, Resp any] struct {
+	*Server
+	MsgType int // the MsgType the values are written with, defaults to TYPED_MSG_TYPE
+}
+
+// NewTypedClient - wraps the client to send values of type Req and receive values of type Resp
+func NewTypedClient[Req, Resp any](c *Client) *TypedClient[Req, Resp] {
+	return &TypedClient[Req, Resp]{Client: c, MsgType: TYPED_MSG_TYPE}
+}
+
+// NewTypedServer - wraps the server to receive values of type Req and send values of type Resp
+func NewTypedServer[Req, Resp any](s *Server) *TypedServer[Req, Resp] {
+	return &TypedServer[Req, Resp]{Server: s, MsgType: TYPED_MSG_TYPE}
+}
+
+// Send - writes the request to the server
+func (tc *TypedClient[Req, Resp]) Send(request Req) error {
+	return tc.WriteValue(tc.MsgType, request)
+}
+
+// Recv - blocks until a response is received from the server
+func (tc *TypedClient[Req, Resp]) Recv() (Resp, error) {
+	return recvTyped[Resp](&tc.Actor, tc.MsgType)
+}
+
+// Send - writes the response to the client
+func (ts *TypedServer[Req, Resp]) Send(response Resp) error {
+	return ts.WriteValue(ts.MsgType, response)
+}
+
+// Recv - blocks until a request is received from the client
+func (ts *TypedServer[Req, Resp]) Recv() (Req, error) {
+	return recvTyped[Req](&ts.Actor, ts.MsgType)
+}
+
+func recvTyped[T any](a *Actor, msgType int) (T, error) {
+
+	var value T
+
+	m, err := a.Read()
+	if err != nil {
+		return value, err
+	}
+
+	if m.MsgType != msgType {
+		err = errors.New(fmt.Sprintf("received a message of type %d instead of %d", m.MsgType, msgType))
+		a.logger.Errorf("%s.Recv err: %s", a, err)
+		return value, err
+	}
+
+	err = a.Decode(m, &value)
+
+	return value, err
+}
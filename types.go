@@ -1,39 +1,77 @@
 package ipc
 
 import (
+	"context"
 	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/tls"
 	"github.com/sirupsen/logrus"
+	"io"
 	"net"
 	"sync"
 	"time"
 )
 
 type Actor struct {
-	status    Status
-	conn      net.Conn
-	received  chan (*Message)
-	toWrite   chan (*Message)
-	logger    *logrus.Logger
-	config    *ActorConfig
-	cipher    *cipher.AEAD
-	clientRef *Client
-	mutex     *sync.Mutex
+	status               Status
+	conn                 net.Conn
+	received             chan (*Message)
+	toWrite              chan (*frame) // the frames of PriorityNormal
+	toWriteHigh          chan (*frame)
+	toWriteLow           chan (*frame)
+	logger               *logrus.Logger
+	config               *ActorConfig
+	cipher               *cipher.AEAD
+	nonces               *nonceCounters // the numbers of the messages encrypted with the cipher
+	transport            Transport
+	calls                *callRegistry
+	streams              *streamRegistry
+	tunnel               *netConn
+	session              *session
+	flow                 *flowControl
+	lastReceived         *int64 // the time in unix nanoseconds the last frame was received
+	delivering           *int32 // the number of messages waiting for Read, the other side isn't timed out meanwhile
+	codec                Codec
+	identity             *PeerIdentity        // the identity key the other side proved it has during the handshake
+	tlsState             *tls.ConnectionState // the TLS session of the connection, nil when TLS isn't used
+	compressor           Compressor
+	compressionThreshold int
+	compressing          bool // the other side agreed to use the Compressor during the handshake
+	clientRef            *Client
+	serverRef            *Server
+	mutex                *sync.Mutex
+	events               chan (*Event)
+	eventMutex           *sync.Mutex
+	closeOnce            *sync.Once
+	done                 chan struct{} // closed once the connection won't be used again
 }
 
 // Server - holds the details of the server connection & config.
 type Server struct {
 	Actor
 	listener    net.Listener
-	Connections *ConnectionPool
+	Connections *ConnectionPool  // the servers created for each client when MultiClient is enabled
+	ClientId    int              // assigned to each client connection of a MultiClient server
+	ctx         context.Context  // the context the server was started with
+	pool        *ConnectionPool  // the pool a client connection of a MultiClient server belongs to
+	peer        *PeerCredentials // the process connected to the unix socket, nil when it isn't known
+	keyId       string           // the PreSharedKeyId the client authenticated with
 }
 
 // Client - holds the details of the client connection and config.
 type Client struct {
 	Actor
-	timeout    time.Duration //
-	retryTimer time.Duration // number of seconds before trying to connect again
-	ClientId   int
-	maxMsgSize int //set in the handshake process dictated by the ServerConfig.MaxMsgSize value
+	timeout           time.Duration //
+	retryTimer        time.Duration // number of seconds before trying to connect again
+	ClientId          int           //set in the handshake process when connected to a MultiClient server
+	maxMsgSize        int           //set in the handshake process dictated by the ServerConfig.MaxMsgSize value
+	heartbeatInterval time.Duration // set in the handshake process dictated by the ServerConfig.HeartbeatInterval value
+	heartbeatMisses   int           // set in the handshake process dictated by the ServerConfig.HeartbeatMisses value
+	policy            *ReconnectPolicy
+	outbox            *outbox        // buffers writes while connecting or reconnecting, nil when OutboundBuffer is 0
+	durable           *durableOutbox // persists writes until they are acknowledged, nil without a DurableOutbox
+	ctx               context.Context
+	cancel            context.CancelFunc // stops the client from reconnecting once closed
 }
 
 type ConnectionPool struct {
@@ -41,6 +79,13 @@ type ConnectionPool struct {
 	ServerConfig *ServerConfig
 	Logger       *logrus.Logger
 	mutex        *sync.Mutex
+	server       *Server // the server accepting connections on behalf of the pool
+	joined       chan bool
+	clientIds    map[int]bool        // the ClientIds in use, released when a client server is evicted
+	sessions     map[string]*session // the sessions of evicted client servers which can be resumed until SESSION_TIMEOUT
+	accepting    int                 // the connections accepted which haven't completed the handshake
+	subscribers  map[int]func(*Server)
+	lastSubId    int
 }
 
 type ActorConfig struct {
@@ -51,30 +96,67 @@ type ActorConfig struct {
 
 // ServerConfig - used to pass configuration overrides to ServerStart()
 type ServerConfig struct {
-	Name              string
-	MaxMsgSize        int
-	UnmaskPermissions bool
-	LogLevel          string
-	MultiClient       bool
-	Encryption        bool
+	Name                 string
+	MaxMsgSize           int
+	UnmaskPermissions    bool
+	LogLevel             string
+	MultiClient          bool
+	MaxClients           int // the maximum number of clients of a MultiClient server, 0 is unlimited
+	Encryption           bool
+	Transport            Transport                         // defaults to unix sockets (named pipes on windows) or TCP when built with the network tag
+	Codec                Codec                             // used by WriteValue and ReadValue, defaults to JSONCodec
+	HeartbeatInterval    time.Duration                     // the interval both sides send heartbeats at, 0 disables heartbeats
+	HeartbeatMisses      int                               // the heartbeats which can be missed before the other side is considered dead, defaults to HEARTBEAT_MISSES
+	ReceiveBuffer        int                               // the messages received which are buffered until read, also the window granted to the client. 0 disables flow control
+	SendBuffer           int                               // the messages queued to be written to the connection
+	FlowPolicy           FlowPolicy                        // what a write does when the receive window of the client is full, defaults to FlowBlock
+	Compressor           Compressor                        // compresses the messages written when the client uses a Compressor with the same Name, nil disables compression
+	CompressionThreshold int                               // messages smaller than this aren't compressed, defaults to COMPRESSION_THRESHOLD
+	PreSharedKey         []byte                            // clients must prove they have the key during the handshake, it is also mixed into the encryption key
+	PreSharedKeys        map[string][]byte                 // the keys of each client by the PreSharedKeyId it sends, the PreSharedKey is used for an empty id
+	AllowedUIDs          []uint32                          // only the processes of these users may connect to the unix socket (linux only)
+	AllowedGIDs          []uint32                          // only the processes in these groups, primary or supplementary, may connect, a peer in either list is allowed
+	AuthorizePeer        func(peer *PeerCredentials) error // called before the handshake, the connection is closed when it returns an error
+	IdentityKey          *ecdsa.PrivateKey                 // the long-term key the server proves its identity with, requires Encryption
+	TrustedKeys          []*ecdsa.PublicKey                // the identity keys of the clients allowed to connect, pinned
+	TrustStore           string                            // a directory of the PEM encoded identity keys of the clients allowed to connect, see WriteTrustedKey
+	TLSConfig            *tls.Config                       // the connections are made over TLS instead of the built-in encryption, requires Certificates
 }
 
 // ClientConfig - used to pass configuration overrides to ClientStart()
 type ClientConfig struct {
-	Name        string
-	Timeout     time.Duration // the duration to wait before abandoning a dial attempt
-	RetryTimer  time.Duration // the duration to wait in dial loop iteration and reconnect attempts
-	LogLevel    string
-	MultiClient bool
-	Encryption  bool
+	Name                 string
+	Timeout              time.Duration    // the duration to wait before abandoning a dial attempt
+	RetryTimer           time.Duration    // the duration to wait in dial loop iteration and reconnect attempts
+	ReconnectPolicy      *ReconnectPolicy // the backoff between attempts to connect, by default the RetryTimer is waited forever (or until the Timeout)
+	LogLevel             string
+	MultiClient          bool // Deprecated: clients connect to a MultiClient server the same way, the ClientId is assigned during the handshake
+	Encryption           bool
+	Transport            Transport          // must be the same kind of Transport the server is listening with
+	Codec                Codec              // must have the same Name as the Codec of the server, defaults to JSONCodec
+	OutboundBuffer       int                // the messages buffered while connecting or reconnecting, 0 disables the buffer
+	OutboundPolicy       BufferPolicy       // what a write does when the outbound buffer is full, defaults to BufferBlock
+	DurableOutbox        *DurableOutbox     // persists the messages written until the server acknowledges them, nil disables it
+	ReceiveBuffer        int                // the messages received which are buffered until read, also the window granted to the server. 0 disables flow control
+	SendBuffer           int                // the messages queued to be written to the connection
+	FlowPolicy           FlowPolicy         // what a write does when the receive window of the server is full, defaults to FlowBlock
+	Compressor           Compressor         // compresses the messages written when the server uses a Compressor with the same Name, nil disables compression
+	CompressionThreshold int                // messages smaller than this aren't compressed, defaults to COMPRESSION_THRESHOLD
+	PreSharedKey         []byte             // proves the client to the server during the handshake, the server must prove it has the key too
+	PreSharedKeyId       string             // selects the key of the client from the PreSharedKeys of the server
+	IdentityKey          *ecdsa.PrivateKey  // the long-term key the client proves its identity with, requires Encryption
+	TrustedKeys          []*ecdsa.PublicKey // the identity keys of the servers the client connects to, pinned
+	TrustStore           string             // a directory of the PEM encoded identity keys of the servers the client connects to
+	TLSConfig            *tls.Config        // connects over TLS instead of the built-in encryption, the ServerName defaults to the host of a NetworkTransport
 }
 
 // Message - contains the received message
 type Message struct {
-	Err     error  // details of any error
-	MsgType int    // 0 = reserved , -1 is an internal message (disconnection or error etc), all messages received will be > 0
-	Data    []byte // message data received
-	Status  string // the status of the connection
+	Err       error     // details of any error
+	MsgType   int       // 0 = reserved, all messages received will be > 0
+	Data      []byte    // message data received
+	RequestId uint32    // set when the message is a request made with Client.Call, 0 otherwise
+	Stream    io.Reader // set when the message is a stream opened with OpenStream, read it until io.EOF
 }
 
 // Status - Status of the connection
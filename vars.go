@@ -1,17 +1,27 @@
 package ipc
 
-import "github.com/sirupsen/logrus"
+import (
+	"github.com/sirupsen/logrus"
+	"time"
+)
 
 const (
-	VERSION                = 2       // ipc package VERSION
-	MAX_MSG_SIZE           = 3145728 // 3Mb  - Maximum bytes allowed for each message
-	DEFAULT_WAIT           = 10
-	DEFAULT_LOG_LEVEL      = logrus.ErrorLevel //
-	SOCKET_NAME_BASE       = "/tmp/"
-	SOCKET_NAME_EXT        = ".sock"
-	CLIENT_CONNECT_MSGTYPE = 12
-	ENCRYPT_BY_DEFAULT     = true
-	DEFAULT_NETWORK_TYPE   = "tcp"
-	DEFAULT_NETWORK_HOST   = "127.0.0.1"
-	DEFAULT_NETWORK_PORT   = 8100
+	VERSION               = 15      // ipc package VERSION
+	MAX_MSG_SIZE          = 3145728 // 3Mb  - Maximum bytes allowed for each message
+	DEFAULT_WAIT          = 10
+	DEFAULT_LOG_LEVEL     = logrus.ErrorLevel //
+	SOCKET_NAME_BASE      = "/tmp/"
+	SOCKET_NAME_EXT       = ".sock"
+	ENCRYPT_BY_DEFAULT    = true
+	EVENT_BUFFER_SIZE     = 32          // the number of undelivered Events held before the oldest is discarded
+	TYPED_MSG_TYPE        = 1           // the MsgType used by TypedClient and TypedServer unless overridden
+	HEARTBEAT_MISSES      = 3           // the heartbeats which can be missed before the other side is considered dead
+	STREAM_BUFFER_SIZE    = 4           // the number of received chunks of a stream or NetConn waiting to be read before the connection stops reading
+	SESSION_TIMEOUT       = time.Minute // how long a MultiClient server keeps the session of a disconnected client for it to be resumed
+	OUTBOX_SEGMENT_SIZE   = 8 << 20     // the size of a DurableOutbox segment file before a new one is started
+	FRAGMENT_SIZE         = 64 << 10    // frames larger than this are written in fragments so they don't hold up the frames of other priorities
+	COMPRESSION_THRESHOLD = 1024        // messages smaller than this aren't compressed unless the CompressionThreshold is set
+	DEFAULT_NETWORK_TYPE  = "tcp"
+	DEFAULT_NETWORK_HOST  = "127.0.0.1"
+	DEFAULT_NETWORK_PORT  = 8100
 )